@@ -0,0 +1,455 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Layers mark deleted files with whiteout entries. Extracted layers keep them
+// in the form overlayfs understands, so that a layer directory can be used as
+// an overlay lowerdir as is: a whiteout is a character device with device
+// number 0/0, and an opaque directory, whose lower contents are hidden, has
+// the opaque xattr set.
+const (
+	whiteoutPrefix    = ".wh."
+	whiteoutOpaqueDir = ".wh..wh..opq"
+	paxXattrPrefix    = "SCHILY.xattr."
+)
+
+// overlayOpaqueXattr returns the xattr marking opaque directories. Trusted
+// xattrs are out of reach in a user namespace, so rootless mode uses the user
+// ones, which overlay honours when mounted with the userxattr option.
+func overlayOpaqueXattr() string {
+	if isRootless() {
+		return "user.overlay.opaque"
+	}
+	return "trusted.overlay.opaque"
+}
+
+// extractTar unpacks the layer tar stream r into dir. Ownership, modes,
+// xattrs, mtimes, hardlinks and device nodes are preserved and whiteouts are
+// converted to their overlay form. Symlinks extracted earlier are followed
+// within dir, and entries that would end up outside of it, whether by their
+// name, a hardlink target or through such a symlink, are rejected.
+func extractTar(r io.Reader, dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("error creating directory: %w", err)
+	}
+
+	type dirTimes struct {
+		path    string
+		modTime time.Time
+		atime   time.Time
+	}
+	var dirs []dirTimes
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading layer archive: %w", err)
+		}
+
+		name, err := cleanEntryName(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if name == "." && hdr.Typeflag != tar.TypeDir {
+			continue
+		}
+
+		parent, base := path.Split(name)
+		if base == whiteoutOpaqueDir {
+			err = extractOpaqueDir(dir, parent)
+		} else if strings.HasPrefix(base, whiteoutPrefix) {
+			err = extractWhiteout(dir, parent, strings.TrimPrefix(base, whiteoutPrefix))
+		} else {
+			err = extractEntry(tr, hdr, dir, name)
+		}
+		if err != nil {
+			return fmt.Errorf("error extracting %s: %w", hdr.Name, err)
+		}
+
+		if hdr.Typeflag == tar.TypeDir {
+			target, err := lookupEntryPath(dir, name)
+			if err != nil {
+				return fmt.Errorf("error extracting %s: %w", hdr.Name, err)
+			}
+			dirs = append(dirs, dirTimes{path: target, modTime: hdr.ModTime, atime: hdr.AccessTime})
+		}
+	}
+
+	// Creating entries changes the mtime of their directory, so directories
+	// get theirs last, deepest first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err := lutimes(dirs[i].path, dirs[i].atime, dirs[i].modTime)
+		if err != nil {
+			return fmt.Errorf("error setting times of %s: %w", dirs[i].path, err)
+		}
+	}
+
+	return nil
+}
+
+// cleanEntryName returns name relative to the root of the archive, refusing
+// names that climb out of it.
+func cleanEntryName(name string) (string, error) {
+	cleaned := path.Clean(strings.TrimLeft(name, "/"))
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("invalid layer entry %q: path escapes the layer root", name)
+	}
+	return cleaned, nil
+}
+
+// maxSymlinkDepth is how many symlinks resolving a single entry path may go
+// through, as many as the Linux kernel allows.
+const maxSymlinkDepth = 40
+
+// resolveEntryPath returns the path of the entry name below dir, creating
+// missing parent directories. Symlinks among the parents are followed the way
+// they would be with dir as the root directory; one that leads out of dir is
+// an error.
+func resolveEntryPath(dir, name string) (string, error) {
+	parent, err := resolveInRoot(dir, path.Dir(name), true)
+	if err != nil {
+		return "", fmt.Errorf("invalid layer entry %q: %w", name, err)
+	}
+	return filepath.Join(parent, path.Base(name)), nil
+}
+
+// lookupEntryPath is resolveEntryPath for entries that have to exist already,
+// such as hardlink targets. It creates nothing.
+func lookupEntryPath(dir, name string) (string, error) {
+	parent, err := resolveInRoot(dir, path.Dir(name), false)
+	if err != nil {
+		return "", fmt.Errorf("invalid layer entry %q: %w", name, err)
+	}
+	return filepath.Join(parent, path.Base(name)), nil
+}
+
+// resolveInRoot returns the path of the directory name below root, following
+// symlinks with root as the root directory: absolute targets start over from
+// root, and climbing above it is an error. Missing directories are created
+// when create is set.
+func resolveInRoot(root, name string, create bool) (string, error) {
+	var resolved []string
+	pending := strings.Split(name, "/")
+	symlinks := 0
+	for len(pending) > 0 {
+		component := pending[0]
+		pending = pending[1:]
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return "", fmt.Errorf("path escapes the layer root")
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		current := filepath.Join(root, filepath.Join(resolved...), component)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) && create {
+			err = os.Mkdir(current, 0755)
+			if err != nil {
+				return "", err
+			}
+			resolved = append(resolved, component)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			symlinks++
+			if symlinks > maxSymlinkDepth {
+				return "", fmt.Errorf("too many levels of symbolic links")
+			}
+			target, err := os.Readlink(current)
+			if err != nil {
+				return "", err
+			}
+			if path.IsAbs(target) {
+				resolved = nil
+			}
+			pending = append(strings.Split(target, "/"), pending...)
+			continue
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("%s is not a directory", path.Join(append(resolved, component)...))
+		}
+		resolved = append(resolved, component)
+	}
+
+	return filepath.Join(root, filepath.Join(resolved...)), nil
+}
+
+// removeExisting makes room for a new entry at target. Directories are only
+// replaced by something that is not a directory.
+func removeExisting(target string, keepDir bool) error {
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if keepDir && info.IsDir() {
+		return nil
+	}
+	return os.RemoveAll(target)
+}
+
+func extractEntry(tr *tar.Reader, hdr *tar.Header, dir, name string) error {
+	target, err := resolveEntryPath(dir, name)
+	if err != nil {
+		return err
+	}
+
+	err = removeExisting(target, hdr.Typeflag == tar.TypeDir)
+	if err != nil {
+		return err
+	}
+
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		err = os.Mkdir(target, 0755)
+		if os.IsExist(err) {
+			err = nil
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		err = writeEntryFile(target, tr)
+	case tar.TypeSymlink:
+		err = os.Symlink(hdr.Linkname, target)
+	case tar.TypeLink:
+		// A hardlink shares the metadata of its target.
+		return extractHardlink(dir, target, hdr.Linkname)
+	case tar.TypeChar, tar.TypeBlock:
+		deviceType := uint32(syscall.S_IFCHR)
+		if hdr.Typeflag == tar.TypeBlock {
+			deviceType = syscall.S_IFBLK
+		}
+		err = syscall.Mknod(target, deviceType|mode, makeDev(hdr.Devmajor, hdr.Devminor))
+		if errors.Is(err, syscall.EPERM) && isRootless() {
+			// Device nodes cannot be created in a user namespace; the
+			// container gets its /dev from the runtime anyway.
+			return nil
+		}
+	case tar.TypeFifo:
+		err = syscall.Mknod(target, syscall.S_IFIFO|mode, 0)
+	default:
+		// Global headers and other metadata-only entries carry no file.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return applyEntryMetadata(target, hdr)
+}
+
+func writeEntryFile(target string, r io.Reader) error {
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func extractHardlink(dir, target, linkname string) error {
+	linkname, err := cleanEntryName(linkname)
+	if err != nil {
+		return err
+	}
+	source, err := lookupEntryPath(dir, linkname)
+	if err != nil {
+		return err
+	}
+	return os.Link(source, target)
+}
+
+// applyEntryMetadata sets ownership, xattrs, mode and times of an extracted
+// entry, in that order since changing the owner clears setuid bits.
+func applyEntryMetadata(target string, hdr *tar.Header) error {
+	if os.Geteuid() == 0 {
+		err := os.Lchown(target, hdr.Uid, hdr.Gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	for key, value := range hdr.PAXRecords {
+		attr, found := strings.CutPrefix(key, paxXattrPrefix)
+		if !found {
+			continue
+		}
+		err := lsetxattr(target, attr, []byte(value))
+		if err != nil && !errors.Is(err, syscall.ENOTSUP) && !errors.Is(err, syscall.EPERM) {
+			return fmt.Errorf("error setting xattr %s: %w", attr, err)
+		}
+	}
+
+	if hdr.Typeflag == tar.TypeSymlink {
+		return lutimes(target, hdr.AccessTime, hdr.ModTime)
+	}
+
+	err := os.Chmod(target, os.FileMode(hdr.Mode&0777)|tarModeBits(hdr.Mode))
+	if err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+
+	return lutimes(target, hdr.AccessTime, hdr.ModTime)
+}
+
+func tarModeBits(mode int64) os.FileMode {
+	var bits os.FileMode
+	if mode&04000 != 0 {
+		bits |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		bits |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		bits |= os.ModeSticky
+	}
+	return bits
+}
+
+// extractWhiteout records that the entry base of directory parent was
+// deleted in this layer.
+func extractWhiteout(dir, parent, base string) error {
+	if base == "" || base == "." || base == ".." || strings.Contains(base, "/") {
+		return fmt.Errorf("invalid whiteout for %q", base)
+	}
+	target, err := resolveEntryPath(dir, path.Join(parent, base))
+	if err != nil {
+		return err
+	}
+
+	err = removeExisting(target, false)
+	if err != nil {
+		return err
+	}
+
+	return syscall.Mknod(target, syscall.S_IFCHR, 0)
+}
+
+// extractOpaqueDir records that the contents of directory name in lower
+// layers are hidden by this layer.
+func extractOpaqueDir(dir, name string) error {
+	name, err := cleanEntryName(name)
+	if err != nil {
+		return err
+	}
+	target, err := resolveInRoot(dir, name, true)
+	if err != nil {
+		return fmt.Errorf("invalid layer entry %q: %w", name, err)
+	}
+
+	return lsetxattr(target, overlayOpaqueXattr(), []byte("y"))
+}
+
+// isWhiteout reports whether info describes an overlay whiteout.
+func isWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+// isOpaqueDir reports whether the directory at dirPath hides the contents of
+// lower layers.
+func isOpaqueDir(dirPath string) bool {
+	value := make([]byte, 1)
+	n, err := syscall.Getxattr(dirPath, overlayOpaqueXattr(), value)
+	return err == nil && n == 1 && value[0] == 'y'
+}
+
+// makeDev encodes a device number the way the Linux kernel expects it.
+func makeDev(major, minor int64) int {
+	return int((minor & 0xff) | (major&0xfff)<<8 | (minor&^0xff)<<12 | (major&^0xfff)<<32)
+}
+
+// lsetxattr sets an extended attribute without following symlinks, which the
+// syscall package has no wrapper for.
+func lsetxattr(filePath, attr string, value []byte) error {
+	pathPtr, err := syscall.BytePtrFromString(filePath)
+	if err != nil {
+		return err
+	}
+	attrPtr, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return err
+	}
+
+	var valuePtr unsafe.Pointer
+	if len(value) > 0 {
+		valuePtr = unsafe.Pointer(&value[0])
+	}
+
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(attrPtr)), uintptr(valuePtr), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// lutimes sets the access and modification times of filePath without
+// following symlinks. A zero access time is set to the modification time;
+// without a modification time nothing is changed.
+func lutimes(filePath string, atime, mtime time.Time) error {
+	if mtime.IsZero() {
+		return nil
+	}
+	if atime.IsZero() {
+		atime = mtime
+	}
+
+	pathPtr, err := syscall.BytePtrFromString(filePath)
+	if err != nil {
+		return err
+	}
+	times := [2]syscall.Timespec{
+		syscall.NsecToTimespec(atime.UnixNano()),
+		syscall.NsecToTimespec(mtime.UnixNano()),
+	}
+
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(atFdCwd), uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(&times[0])), atSymlinkNoFollow, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// The syscall package keeps these Linux constants unexported. atFdCwd is a
+// variable so that its negative value converts to uintptr.
+var atFdCwd = -0x64
+
+const atSymlinkNoFollow = 0x100
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// testEntry is an entry of a layer archive built by buildTar, a regular file
+// unless typeflag says otherwise.
+type testEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+}
+
+// buildTar returns a layer archive of entries owned by the current user, so
+// that extracting them needs no privileges.
+func buildTar(t *testing.T, entries ...testEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+			Mode:     0644,
+			Uid:      os.Getuid(),
+			Gid:      os.Getgid(),
+		}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		hdr.Size = int64(len(entry.content))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func requireRoot(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("creating whiteouts requires root")
+	}
+}
+
+// extractTestTar extracts entries into a new directory and returns it along
+// with the error.
+func extractTestTar(t *testing.T, entries ...testEntry) (string, error) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "rootfs")
+	return dir, extractTar(buildTar(t, entries...), dir)
+}
+
+func TestExtractTarRejectsParentDirEntries(t *testing.T) {
+	for _, name := range []string{"../escaped", "a/../../escaped", "/../escaped"} {
+		_, err := extractTestTar(t, testEntry{name: name, content: "x"})
+		if err == nil || !strings.Contains(err.Error(), "escapes the layer root") {
+			t.Errorf("extracting %q: err = %v, want an escape error", name, err)
+		}
+	}
+}
+
+func TestExtractTarConfinesAbsoluteSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	dir, err := extractTestTar(t,
+		testEntry{name: "evil", typeflag: tar.TypeSymlink, linkname: outside},
+		testEntry{name: "evil/pwned", content: "x"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertNotExist(t, filepath.Join(outside, "pwned"))
+	assertFileContent(t, filepath.Join(dir, outside, "pwned"), "x")
+}
+
+func TestExtractTarRejectsRelativeSymlinkEscape(t *testing.T) {
+	dir, err := extractTestTar(t,
+		testEntry{name: "a/", typeflag: tar.TypeDir},
+		testEntry{name: "a/up", typeflag: tar.TypeSymlink, linkname: "../.."},
+		testEntry{name: "a/up/pwned", content: "x"},
+	)
+	if err == nil || !strings.Contains(err.Error(), "escapes the layer root") {
+		t.Errorf("err = %v, want an escape error", err)
+	}
+	assertNotExist(t, filepath.Join(filepath.Dir(dir), "pwned"))
+}
+
+func TestExtractTarFollowsSymlinksWithinRoot(t *testing.T) {
+	dir, err := extractTestTar(t,
+		testEntry{name: "usr/lib/", typeflag: tar.TypeDir},
+		testEntry{name: "lib", typeflag: tar.TypeSymlink, linkname: "usr/lib"},
+		testEntry{name: "lib/libc.so", content: "libc"},
+		testEntry{name: "var/run", typeflag: tar.TypeSymlink, linkname: "/run"},
+		testEntry{name: "var/run/lock/", typeflag: tar.TypeDir},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertFileContent(t, filepath.Join(dir, "usr/lib/libc.so"), "libc")
+	if info, err := os.Lstat(filepath.Join(dir, "lib")); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("lib is no longer a symlink (err = %v)", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "run/lock")); err != nil || !info.IsDir() {
+		t.Errorf("run/lock is not a directory (err = %v)", err)
+	}
+}
+
+func TestExtractTarHardlinks(t *testing.T) {
+	dir, err := extractTestTar(t,
+		testEntry{name: "usr/lib/libc.so", content: "libc"},
+		testEntry{name: "lib", typeflag: tar.TypeSymlink, linkname: "usr/lib"},
+		testEntry{name: "libc-link", typeflag: tar.TypeLink, linkname: "lib/libc.so"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original, err := os.Stat(filepath.Join(dir, "usr/lib/libc.so"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := os.Stat(filepath.Join(dir, "libc-link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(original, link) {
+		t.Error("libc-link is not a hardlink to usr/lib/libc.so")
+	}
+}
+
+func TestExtractTarHardlinkToMissingTargetCreatesNothing(t *testing.T) {
+	dir, err := extractTestTar(t,
+		testEntry{name: "link", typeflag: tar.TypeLink, linkname: "missing/dir/file"},
+	)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("err = %v, want a not-exist error", err)
+	}
+	assertNotExist(t, filepath.Join(dir, "missing"))
+}
+
+func TestExtractTarRejectsHardlinkEscape(t *testing.T) {
+	_, err := extractTestTar(t,
+		testEntry{name: "link", typeflag: tar.TypeLink, linkname: "../etc/passwd"},
+	)
+	if err == nil || !strings.Contains(err.Error(), "escapes the layer root") {
+		t.Errorf("err = %v, want an escape error", err)
+	}
+}
+
+func TestExtractTarWhiteout(t *testing.T) {
+	requireRoot(t)
+	dir, err := extractTestTar(t,
+		testEntry{name: "etc/kept", content: "x"},
+		testEntry{name: "etc/.wh.deleted"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Lstat(filepath.Join(dir, "etc/deleted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isWhiteout(info) {
+		t.Errorf("etc/deleted has mode %v, want a 0/0 character device", info.Mode())
+	}
+	assertNotExist(t, filepath.Join(dir, "etc/.wh.deleted"))
+}
+
+func TestExtractTarOpaqueDir(t *testing.T) {
+	dir, err := extractTestTar(t,
+		testEntry{name: "data/new", content: "x"},
+		testEntry{name: "data/.wh..wh..opq"},
+	)
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENOTSUP) {
+		t.Skipf("cannot set %s: %v", overlayOpaqueXattr(), err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !isOpaqueDir(filepath.Join(dir, "data")) {
+		t.Error("data is not marked opaque")
+	}
+	assertNotExist(t, filepath.Join(dir, "data/.wh..wh..opq"))
+	assertFileContent(t, filepath.Join(dir, "data/new"), "x")
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Each container runs in a cgroup of its own, cgroupParentName/<ID> in the
+// cgroup v2 hierarchy, which carries its resource limits and is removed when
+// the container exits.
+const (
+	cgroupMountPath  = "/sys/fs/cgroup"
+	cgroupParentName = "mydocker"
+	cgroup2Magic     = 0x63677270
+	cpuPeriod        = 100000
+)
+
+// containerResources are the resource limits of a container. Zero values
+// leave a resource unlimited.
+type containerResources struct {
+	// Memory is the memory limit in bytes.
+	Memory int64
+	// MemorySwap limits memory plus swap, -1 meaning unlimited swap. It
+	// defaults to twice Memory.
+	MemorySwap int64
+	Cpus       float64
+	// CpuShares is the relative CPU weight, 1024 being the default.
+	CpuShares int64
+	// PidsLimit is the maximum number of processes, -1 meaning unlimited.
+	PidsLimit int64
+	// BlkioWeight is the relative block IO weight, from 10 to 1000.
+	BlkioWeight int64
+}
+
+func (r containerResources) limited() bool {
+	return r != containerResources{}
+}
+
+// controllers returns the cgroup controllers the limits need.
+func (r containerResources) controllers() []string {
+	var controllers []string
+	if r.Memory != 0 || r.MemorySwap != 0 {
+		controllers = append(controllers, "memory")
+	}
+	if r.Cpus != 0 || r.CpuShares != 0 {
+		controllers = append(controllers, "cpu")
+	}
+	if r.PidsLimit != 0 {
+		controllers = append(controllers, "pids")
+	}
+	if r.BlkioWeight != 0 {
+		controllers = append(controllers, "io")
+	}
+	return controllers
+}
+
+// cgroupFile is a value to write to an interface file of a cgroup. Optional
+// values are skipped when the kernel lacks the file.
+type cgroupFile struct {
+	name     string
+	value    string
+	optional bool
+}
+
+// cgroupFiles returns the interface file values for the limits, converting
+// Docker's cgroup v1 style values the way runc does.
+func (r containerResources) cgroupFiles() []cgroupFile {
+	var files []cgroupFile
+	if r.Memory > 0 {
+		files = append(files, cgroupFile{name: "memory.max", value: strconv.FormatInt(r.Memory, 10)})
+		// cgroup v2 limits swap on its own rather than memory plus swap.
+		// The default, twice the memory limit, only applies with swap
+		// accounting.
+		switch {
+		case r.MemorySwap < 0:
+			files = append(files, cgroupFile{name: "memory.swap.max", value: "max"})
+		case r.MemorySwap > 0:
+			files = append(files, cgroupFile{name: "memory.swap.max", value: strconv.FormatInt(r.MemorySwap-r.Memory, 10)})
+		default:
+			files = append(files, cgroupFile{name: "memory.swap.max", value: strconv.FormatInt(r.Memory, 10), optional: true})
+		}
+	}
+	if r.Cpus > 0 {
+		files = append(files, cgroupFile{name: "cpu.max", value: fmt.Sprintf("%d %d", int64(r.Cpus*cpuPeriod), cpuPeriod)})
+	}
+	if r.CpuShares > 0 {
+		files = append(files, cgroupFile{name: "cpu.weight", value: strconv.FormatInt(1+(r.CpuShares-2)*9999/262142, 10)})
+	}
+	switch {
+	case r.PidsLimit < 0:
+		files = append(files, cgroupFile{name: "pids.max", value: "max"})
+	case r.PidsLimit > 0:
+		files = append(files, cgroupFile{name: "pids.max", value: strconv.FormatInt(r.PidsLimit, 10)})
+	}
+	if r.BlkioWeight > 0 {
+		files = append(files, cgroupFile{name: "io.weight", value: fmt.Sprintf("default %d", 1+(r.BlkioWeight-10)*9999/990)})
+	}
+	return files
+}
+
+// validate checks the limits the way Docker does before creating anything.
+func (r containerResources) validate(cpuCount int) error {
+	switch {
+	case r.Memory != 0 && r.Memory < 6*1024*1024:
+		return fmt.Errorf("minimum memory limit allowed is 6MB")
+	case r.MemorySwap != 0 && r.Memory == 0:
+		return fmt.Errorf("you should always set the memory limit when using the memory-swap limit")
+	case r.MemorySwap > 0 && r.MemorySwap < r.Memory:
+		return fmt.Errorf("minimum memory-swap limit should be larger than the memory limit")
+	case r.Cpus < 0 || r.Cpus > float64(cpuCount) || (r.Cpus > 0 && r.Cpus*cpuPeriod < 1000):
+		return fmt.Errorf("range of CPUs is from 0.01 to %d.00, as there are only %d CPUs available", cpuCount, cpuCount)
+	case r.CpuShares != 0 && (r.CpuShares < 2 || r.CpuShares > 262144):
+		return fmt.Errorf("cpu-shares must be between 2 and 262144")
+	case r.PidsLimit < -1:
+		return fmt.Errorf("pids-limit must be -1 (unlimited) or positive")
+	case r.BlkioWeight != 0 && (r.BlkioWeight < 10 || r.BlkioWeight > 1000):
+		return fmt.Errorf("range of blkio weight is from 10 to 1000")
+	}
+	return nil
+}
+
+type cgroup struct {
+	path string
+	dir  *os.File
+}
+
+// createCgroup creates the cgroup of a container. Without cgroup v2, or
+// where mydocker may not create cgroups, as in rootless mode without
+// delegation, containers without limits run in mydocker's cgroup instead:
+// it returns nil then.
+func createCgroup(name string, resources containerResources) (*cgroup, error) {
+	cg, err := newCgroup(name, resources)
+	if err != nil && !resources.limited() {
+		return nil, nil
+	}
+	return cg, err
+}
+
+func newCgroup(name string, resources containerResources) (*cgroup, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(cgroupMountPath, &stat)
+	if err != nil || stat.Type != cgroup2Magic {
+		return nil, fmt.Errorf("resource limits require cgroup v2 mounted at %s", cgroupMountPath)
+	}
+
+	controllers := resources.controllers()
+	err = enableControllers(cgroupMountPath, controllers)
+	if err != nil {
+		return nil, err
+	}
+	parentPath := path.Join(cgroupMountPath, cgroupParentName)
+	err = os.Mkdir(parentPath, 0755)
+	if err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("error creating cgroup: %w", err)
+	}
+	err = enableControllers(parentPath, controllers)
+	if err != nil {
+		return nil, err
+	}
+
+	cgroupPath := path.Join(parentPath, name)
+	err = os.Mkdir(cgroupPath, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cgroup: %w", err)
+	}
+	cg := &cgroup{path: cgroupPath}
+
+	for _, file := range resources.cgroupFiles() {
+		err = os.WriteFile(path.Join(cgroupPath, file.name), []byte(file.value), 0)
+		if errors.Is(err, os.ErrNotExist) && file.optional {
+			continue
+		}
+		if err != nil {
+			cg.remove()
+			return nil, fmt.Errorf("error setting %s: %w", file.name, err)
+		}
+	}
+
+	cg.dir, err = os.Open(cgroupPath)
+	if err != nil {
+		cg.remove()
+		return nil, fmt.Errorf("error opening cgroup: %w", err)
+	}
+
+	return cg, nil
+}
+
+// enableControllers makes controllers available to the children of the
+// cgroup at cgroupPath.
+func enableControllers(cgroupPath string, controllers []string) error {
+	if len(controllers) == 0 {
+		return nil
+	}
+
+	data, err := os.ReadFile(path.Join(cgroupPath, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("error reading cgroup controllers: %w", err)
+	}
+	available := strings.Fields(string(data))
+
+	for _, controller := range controllers {
+		if !containsString(available, controller) {
+			return fmt.Errorf("cgroup controller %s is not available", controller)
+		}
+		err = os.WriteFile(path.Join(cgroupPath, "cgroup.subtree_control"), []byte("+"+controller), 0)
+		if err != nil {
+			return fmt.Errorf("error enabling cgroup controller %s: %w", controller, err)
+		}
+	}
+
+	return nil
+}
+
+// fd returns the file descriptor of the cgroup directory, with which the
+// container is started right in its cgroup.
+func (cg *cgroup) fd() int {
+	return int(cg.dir.Fd())
+}
+
+// oomKills returns how many processes of the cgroup the kernel has killed for
+// exceeding the memory limit.
+func (cg *cgroup) oomKills() int {
+	file, err := os.Open(path.Join(cg.path, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), " ")
+		if key == "oom_kill" {
+			count, _ := strconv.Atoi(value)
+			return count
+		}
+	}
+	return 0
+}
+
+// remove kills whatever is left in the cgroup and deletes it. The kernel
+// frees a cgroup only once its last process has been reaped, which may be
+// shortly after the container's init has.
+func (cg *cgroup) remove() {
+	if cg.dir != nil {
+		_ = cg.dir.Close()
+	}
+	_ = os.WriteFile(path.Join(cg.path, "cgroup.kill"), []byte("1"), 0)
+
+	var err error
+	for attempt := 0; attempt < 50; attempt++ {
+		err = syscall.Rmdir(cg.path)
+		if !errors.Is(err, syscall.EBUSY) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil && !errors.Is(err, syscall.ENOENT) {
+		fmt.Fprintf(os.Stderr, "Error removing cgroup %s: %v\n", cg.path, err)
+	}
+}
+
+// parseByteSize parses a size such as 512m or 1.5GB, with binary units as
+// Docker uses for memory limits.
+func parseByteSize(value string) (int64, error) {
+	number := strings.TrimRight(strings.ToLower(value), "bi")
+	multiplier := int64(1)
+	if number != "" {
+		if i := strings.IndexByte("kmgtp", number[len(number)-1]); i >= 0 {
+			multiplier = int64(1) << (10 * (i + 1))
+			number = number[:len(number)-1]
+		}
+	}
+
+	size, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size: %q", value)
+	}
+	return int64(size * float64(multiplier)), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"512b", 512},
+		{"64k", 64 << 10},
+		{"64KB", 64 << 10},
+		{"6m", 6 << 20},
+		{"6MiB", 6 << 20},
+		{"1.5g", 3 << 29},
+		{"2t", 2 << 40},
+		{"1p", 1 << 50},
+	}
+	for _, test := range tests {
+		got, err := parseByteSize(test.value)
+		if err != nil || got != test.want {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d", test.value, got, err, test.want)
+		}
+	}
+
+	for _, value := range []string{"", "b", "m", "-1m", "ten", "1x", "1mm"} {
+		if got, err := parseByteSize(value); err == nil {
+			t.Errorf("parseByteSize(%q) = %d, want an error", value, got)
+		}
+	}
+}
+
+func TestValidateResources(t *testing.T) {
+	const mb = 1 << 20
+	tests := []struct {
+		name      string
+		resources containerResources
+		// err is part of the error message, empty for valid limits.
+		err string
+	}{
+		{"no limits", containerResources{}, ""},
+		{"minimum memory", containerResources{Memory: 6 * mb}, ""},
+		{"too little memory", containerResources{Memory: 6*mb - 1}, "minimum memory limit"},
+		{"swap without memory", containerResources{MemorySwap: 64 * mb}, "always set the memory limit"},
+		{"swap below memory", containerResources{Memory: 64 * mb, MemorySwap: 32 * mb}, "memory-swap limit should be larger"},
+		{"swap equal to memory", containerResources{Memory: 64 * mb, MemorySwap: 64 * mb}, ""},
+		{"unlimited swap", containerResources{Memory: 64 * mb, MemorySwap: -1}, ""},
+		{"all CPUs", containerResources{Cpus: 4}, ""},
+		{"minimum CPUs", containerResources{Cpus: 0.01}, ""},
+		{"too few CPUs", containerResources{Cpus: 0.001}, "range of CPUs is from 0.01 to 4.00"},
+		{"too many CPUs", containerResources{Cpus: 4.5}, "range of CPUs is from 0.01 to 4.00"},
+		{"negative CPUs", containerResources{Cpus: -1}, "range of CPUs"},
+		{"minimum CPU shares", containerResources{CpuShares: 2}, ""},
+		{"too few CPU shares", containerResources{CpuShares: 1}, "cpu-shares must be between 2 and 262144"},
+		{"too many CPU shares", containerResources{CpuShares: 262145}, "cpu-shares must be between 2 and 262144"},
+		{"unlimited pids", containerResources{PidsLimit: -1}, ""},
+		{"negative pids limit", containerResources{PidsLimit: -2}, "pids-limit must be -1"},
+		{"minimum blkio weight", containerResources{BlkioWeight: 10}, ""},
+		{"too low blkio weight", containerResources{BlkioWeight: 9}, "range of blkio weight is from 10 to 1000"},
+		{"too high blkio weight", containerResources{BlkioWeight: 1001}, "range of blkio weight is from 10 to 1000"},
+	}
+	for _, test := range tests {
+		err := test.resources.validate(4)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: err = %v, want none", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: err = %v, want one containing %q", test.name, err, test.err)
+		}
+	}
+}
+
+// cgroupFileValue returns the value resources write to the interface file
+// name, empty if they leave it alone.
+func cgroupFileValue(resources containerResources, name string) string {
+	for _, file := range resources.cgroupFiles() {
+		if file.name == name {
+			return file.value
+		}
+	}
+	return ""
+}
+
+func TestCgroupFilesConvertWeights(t *testing.T) {
+	tests := []struct {
+		resources containerResources
+		file      string
+		want      string
+	}{
+		{containerResources{CpuShares: 2}, "cpu.weight", "1"},
+		{containerResources{CpuShares: 1024}, "cpu.weight", "39"},
+		{containerResources{CpuShares: 262144}, "cpu.weight", "10000"},
+		{containerResources{BlkioWeight: 10}, "io.weight", "default 1"},
+		{containerResources{BlkioWeight: 500}, "io.weight", "default 4950"},
+		{containerResources{BlkioWeight: 1000}, "io.weight", "default 10000"},
+		{containerResources{}, "cpu.weight", ""},
+		{containerResources{}, "io.weight", ""},
+	}
+	for _, test := range tests {
+		if got := cgroupFileValue(test.resources, test.file); got != test.want {
+			t.Errorf("%s for %+v = %q, want %q", test.file, test.resources, got, test.want)
+		}
+	}
+}
+
+func TestCgroupFilesLimitMemoryAndSwap(t *testing.T) {
+	const mb = 1 << 20
+	tests := []struct {
+		resources containerResources
+		swap      string
+	}{
+		{containerResources{Memory: 64 * mb}, "67108864"},
+		{containerResources{Memory: 64 * mb, MemorySwap: 96 * mb}, "33554432"},
+		{containerResources{Memory: 64 * mb, MemorySwap: -1}, "max"},
+	}
+	for _, test := range tests {
+		if got := cgroupFileValue(test.resources, "memory.max"); got != "67108864" {
+			t.Errorf("memory.max for %+v = %q, want 67108864", test.resources, got)
+		}
+		if got := cgroupFileValue(test.resources, "memory.swap.max"); got != test.swap {
+			t.Errorf("memory.swap.max for %+v = %q, want %q", test.resources, got, test.swap)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+)
+
+// authChallenge is a single challenge from a WWW-Authenticate header, e.g.
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io".
+type authChallenge struct {
+	Scheme string
+	Params map[string]string
+}
+
+// parseAuthChallenges parses the values of all WWW-Authenticate headers of a
+// response. A header may carry several comma separated challenges; a new
+// challenge starts at every token that is not followed by "=".
+func parseAuthChallenges(headers []string) []authChallenge {
+	var challenges []authChallenge
+
+	for _, header := range headers {
+		s := header
+		var current *authChallenge
+
+		for {
+			s = skipSpaceAndCommas(s)
+			if s == "" {
+				break
+			}
+
+			var token string
+			token, s = readToken(s)
+			if token == "" {
+				// Unparseable input; give up on the rest of this header.
+				break
+			}
+
+			rest := strings.TrimLeft(s, " \t")
+			if !strings.HasPrefix(rest, "=") || current == nil {
+				challenges = append(challenges, authChallenge{Scheme: token, Params: map[string]string{}})
+				current = &challenges[len(challenges)-1]
+				continue
+			}
+
+			rest = strings.TrimLeft(rest[1:], " \t")
+			var value string
+			if strings.HasPrefix(rest, `"`) {
+				value, s = readQuotedString(rest)
+			} else {
+				value, s = readToken(rest)
+			}
+			current.Params[strings.ToLower(token)] = value
+		}
+	}
+
+	return challenges
+}
+
+func skipSpaceAndCommas(s string) string {
+	return strings.TrimLeft(s, " \t,")
+}
+
+func readToken(s string) (string, string) {
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == ',' || r == '=' || r == '"'
+	})
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+func readQuotedString(s string) (string, string) {
+	var value strings.Builder
+	escaped := false
+
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			value.WriteByte(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			return value.String(), s[i+1:]
+		default:
+			value.WriteByte(c)
+		}
+	}
+
+	return value.String(), ""
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAuthChallenges(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		want    []authChallenge
+	}{
+		{
+			name:    "single",
+			headers: []string{`Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`},
+			want: []authChallenge{
+				{Scheme: "Bearer", Params: map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io"}},
+			},
+		},
+		{
+			name:    "several in one header",
+			headers: []string{`Basic realm="Registry Realm", Bearer realm="https://auth.example.com/token", service=example, scope="repository:a/b:pull,push"`},
+			want: []authChallenge{
+				{Scheme: "Basic", Params: map[string]string{"realm": "Registry Realm"}},
+				{Scheme: "Bearer", Params: map[string]string{"realm": "https://auth.example.com/token", "service": "example", "scope": "repository:a/b:pull,push"}},
+			},
+		},
+		{
+			name:    "several headers",
+			headers: []string{`Negotiate`, `Bearer Realm = "https://auth.example.com/token"`},
+			want: []authChallenge{
+				{Scheme: "Negotiate", Params: map[string]string{}},
+				{Scheme: "Bearer", Params: map[string]string{"realm": "https://auth.example.com/token"}},
+			},
+		},
+		{
+			name:    "escaped quotes",
+			headers: []string{`Bearer realm="https://auth.example.com/token",error="say \"hi\""`},
+			want: []authChallenge{
+				{Scheme: "Bearer", Params: map[string]string{"realm": "https://auth.example.com/token", "error": `say "hi"`}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := parseAuthChallenges(test.headers)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseAuthChallenges(%q) = %+v, want %+v", test.headers, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+type cliCommand struct {
+	name        string
+	usage       string
+	description string
+	handler     func(cmd *cliCommand, args []string) int
+	// hostNamespace commands run rootless in the user namespace of the
+	// invoking user rather than in mydocker's own.
+	hostNamespace bool
+}
+
+var commands = []*cliCommand{
+	{name: "run", usage: "run [OPTIONS] IMAGE [COMMAND] [ARG...]", description: "Run a command in a new container", handler: runCmd},
+	{name: "pull", usage: "pull [OPTIONS] IMAGE", description: "Download an image from a registry", handler: pullCmd},
+	{name: "images", usage: "images", description: "List images", handler: imagesCmd},
+	{name: "rmi", usage: "rmi [OPTIONS] IMAGE [IMAGE...]", description: "Remove one or more images", handler: rmiCmd},
+	{name: "ps", usage: "ps [OPTIONS]", description: "List containers", handler: psCmd},
+	{name: "stop", usage: "stop [OPTIONS] CONTAINER [CONTAINER...]", description: "Stop one or more running containers", handler: stopCmd, hostNamespace: true},
+	{name: "kill", usage: "kill [OPTIONS] CONTAINER [CONTAINER...]", description: "Kill one or more running containers", handler: killCmd, hostNamespace: true},
+	{name: "rm", usage: "rm [OPTIONS] CONTAINER [CONTAINER...]", description: "Remove one or more containers", handler: rmCmd},
+	{name: "wait", usage: "wait CONTAINER [CONTAINER...]", description: "Block until one or more containers stop, then print their exit codes", handler: waitCmd},
+	{name: "exec", usage: "exec CONTAINER COMMAND [ARG...]", description: "Run a command in a running container", handler: execCmd, hostNamespace: true},
+	{name: "login", usage: "login [OPTIONS] [SERVER]", description: "Log in to a registry", handler: loginCmd},
+	{name: "logout", usage: "logout [SERVER]", description: "Log out from a registry", handler: logoutCmd},
+	{name: "inspect", usage: "inspect IMAGE", description: "Display detailed information on an image", handler: inspectCmd},
+	{name: "version", usage: "version", description: "Show the mydocker version information", handler: versionCmd},
+}
+
+func dispatch(args []string) int {
+	if len(args) == 0 {
+		printUsage(os.Stderr)
+		return 2
+	}
+
+	switch args[0] {
+	case "help", "-h", "--help":
+		printUsage(os.Stdout)
+		return 0
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "mydocker: '%s' is not a mydocker command.\n", args[0])
+		fmt.Fprintln(os.Stderr, "See 'mydocker --help'.")
+		return 2
+	}
+
+	return cmd.handler(cmd, args[1:])
+}
+
+func findCommand(name string) *cliCommand {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: mydocker COMMAND [OPTIONS]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.name, cmd.description)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'mydocker COMMAND --help' for more information on a command.")
+}
+
+func (cmd *cliCommand) flagSet() *flag.FlagSet {
+	flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: mydocker %s\n\n%s\n", cmd.usage, cmd.description)
+		hasFlags := false
+		flags.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintln(os.Stderr, "\nOptions:")
+			flags.PrintDefaults()
+		}
+	}
+	return flags
+}
+
+// parseFlags parses args into flags and validates the positional argument
+// count. It returns the exit code to use and false when the caller should stop.
+func (cmd *cliCommand) parseFlags(flags *flag.FlagSet, args []string, minArgs, maxArgs int) (int, bool) {
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0, false
+		}
+		return 2, false
+	}
+
+	if flags.NArg() < minArgs || (maxArgs >= 0 && flags.NArg() > maxArgs) {
+		fmt.Fprintf(os.Stderr, "mydocker %s: expected %s\n\n", cmd.name, describeArgCount(minArgs, maxArgs))
+		flags.Usage()
+		return 2, false
+	}
+
+	return 0, true
+}
+
+func describeArgCount(minArgs, maxArgs int) string {
+	plural := func(n int) string {
+		if n == 1 {
+			return "1 argument"
+		}
+		return fmt.Sprintf("%d arguments", n)
+	}
+
+	switch {
+	case minArgs == maxArgs:
+		return "exactly " + plural(minArgs)
+	case maxArgs < 0:
+		return "at least " + plural(minArgs)
+	default:
+		return fmt.Sprintf("between %d and %s", minArgs, plural(maxArgs))
+	}
+}
+
+// stringList is a flag that may be given several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func printError(cmd *cliCommand, err error) {
+	fmt.Fprintf(os.Stderr, "mydocker %s: %s\n", cmd.name, strings.TrimSpace(err.Error()))
+}
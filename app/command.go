@@ -1,50 +1,392 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
 	"syscall"
+	"time"
 )
 
-func runCommand(imageId, commandName string, args []string) (int, error) {
-	sandboxPath, err := sandbox(imageId)
+// runOptions are the settings of a container given on the run command line.
+type runOptions struct {
+	// Entrypoint, when set, replaces the image's entrypoint and its default
+	// command; an empty one clears the entrypoint.
+	Entrypoint *string
+	// Env entries of the form KEY=VALUE are added to the image's environment.
+	// Containers do not inherit the environment of mydocker.
+	Env []string
+	// WorkingDir and User default to those of the image.
+	WorkingDir string
+	User       string
+	// Hostname defaults to the short container ID.
+	Hostname string
+	// Network is one of networkNone, networkHost and networkBridge.
+	Network string
+	// Ports are published on the bridge network only.
+	Ports     []portMapping
+	DNS       dnsConfig
+	Ids       idMap
+	Resources containerResources
+	// Remove has the container removed when it exits rather than kept until
+	// mydocker rm.
+	Remove bool
+}
+
+// runCommand runs a command in a new container of the image and records the
+// container's state as it goes. The command is the image's entrypoint
+// followed by args, or by the image's default command when args are empty.
+// started, unless nil, is called once the command is running.
+func runCommand(state containerState, args []string, options runOptions, started func(containerState)) (int, error) {
+	imageConfig, err := readImageConfig(state.ImageId)
+	if err != nil {
+		return 1, fmt.Errorf("error reading image config: %w", err)
+	}
+	config := imageConfig.Config
+
+	command := containerCommand(config, options.Entrypoint, args)
+	if len(command) == 0 {
+		return 1, fmt.Errorf("no command specified")
+	}
+
+	workingDir := options.WorkingDir
+	if workingDir == "" {
+		workingDir = config.WorkingDir
+	}
+	if workingDir == "" {
+		workingDir = "/"
+	}
+	user := options.User
+	if user == "" {
+		user = config.User
+	}
+	hostname := options.Hostname
+	if hostname == "" {
+		hostname = shortId(state.Id)
+	}
+
+	unlock, err := lockContainer(state.Id)
 	if err != nil {
 		return 1, err
 	}
-	defer cleanupSandbox(sandboxPath)
+	defer unlock()
 
-	sandboxRootFsPath := path.Join(sandboxPath, "rootfs")
+	sandboxPath, err := sandbox(state.Id, state.ImageId, options.Ids)
+	if err != nil {
+		removeContainerState(state.Id)
+		return 1, err
+	}
 
-	command := exec.Command(commandName, args...)
-	command.Stdin = os.Stdin
-	command.Stdout = os.Stdout
-	command.Stderr = os.Stderr
-	command.SysProcAttr = &syscall.SysProcAttr{
-		Chroot:     sandboxRootFsPath,
-		Cloneflags: syscall.CLONE_NEWPID | syscall.CLONE_NEWNET,
+	spec := containerSpec{
+		RootFs:     sandboxRootFsPath(sandboxPath),
+		Args:       command,
+		Env:        mergeEnv([]string{"PATH=" + defaultPath, "HOSTNAME=" + hostname}, config.Env, options.Env),
+		WorkingDir: workingDir,
+		User:       user,
+		Hostname:   hostname,
 	}
+	state.Command = command
+	state.Env = spec.Env
+	state.User = spec.User
+	state.WorkingDir = spec.WorkingDir
+	state.Ports = options.Ports
 
-	err = command.Start()
+	exitCode, err := runContainer(&state, sandboxPath, spec, options, started)
+	if options.Remove {
+		cleanupSandbox(sandboxPath)
+		removeContainerState(state.Id)
+		return exitCode, err
+	}
+
+	// The sandbox is kept with the changes made to it until the container is
+	// removed.
+	_ = unmountSandbox(sandboxPath)
+	state.Status = containerExited
+	state.Pid = 0
+	state.ExitCode = exitCode
+	state.Finished = time.Now()
+	if err != nil {
+		state.Error = err.Error()
+	}
+	if stateErr := writeContainerState(state); err == nil {
+		err = stateErr
+	}
+
+	return exitCode, err
+}
+
+// runContainer sets up the network and cgroup of a container in the
+// sandbox, runs its command and tears them down again once it exits.
+func runContainer(state *containerState, sandboxPath string, spec containerSpec, options runOptions, started func(containerState)) (int, error) {
+	state.Status = containerCreated
+	err := writeContainerState(*state)
 	if err != nil {
 		return 1, err
 	}
 
-	err = command.Wait()
+	sandboxId := path.Base(sandboxPath)
+	network := containerNetwork{Mode: options.Network}
+	if network.Mode == networkBridge {
+		err = setupBridge()
+		if err != nil {
+			return 1, err
+		}
+		network, err = allocateAddress(sandboxId)
+		if err != nil {
+			return 1, err
+		}
+		defer releaseAddress(network)
+
+		if len(options.Ports) > 0 {
+			containerIP, _, _ := net.ParseCIDR(network.Address)
+			releasePorts, err := publishPorts(state.Id, containerIP, options.Ports)
+			if err != nil {
+				return 1, err
+			}
+			defer releasePorts()
+		}
+	}
+
+	spec.Network = network
+	spec.Mounts, err = writeEtcFiles(sandboxPath, spec.Hostname, network, options.DNS)
 	if err != nil {
-		return determineExitCode(err), err
+		return 1, err
+	}
+
+	initCommand := &exec.Cmd{
+		Path:   "/proc/self/exe",
+		Args:   []string{containerInitArg},
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags: syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC | syscall.CLONE_NEWCGROUP,
+		},
+	}
+	if network.Mode != networkHost {
+		initCommand.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	if options.Ids.enabled() {
+		initCommand.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+		initCommand.SysProcAttr.UidMappings = options.Ids.Uids
+		initCommand.SysProcAttr.GidMappings = options.Ids.Gids
+		initCommand.SysProcAttr.GidMappingsEnableSetgroups = true
+		// The host user need not be mapped; init starts as root of the
+		// namespace to set the container up.
+		initCommand.SysProcAttr.Credential = &syscall.Credential{Uid: 0, Gid: 0}
+	}
+
+	// Starting init right in its cgroup makes that the root of its cgroup
+	// namespace.
+	cg, err := createCgroup(state.Id, options.Resources)
+	if err != nil {
+		return 1, err
+	}
+	oomKills := 0
+	if cg != nil {
+		defer cg.remove()
+		initCommand.SysProcAttr.UseCgroupFD = true
+		initCommand.SysProcAttr.CgroupFD = cg.fd()
+		oomKills = cg.oomKills()
+	}
+
+	var attach func(pid int) error
+	if network.Mode == networkBridge {
+		attach = func(pid int) error {
+			return connectContainer(state.Id, pid)
+		}
+	}
+
+	exitCode, err := startContainerCommand(initCommand, spec, attach)
+	if err != nil {
+		return exitCode, err
+	}
+
+	state.Status = containerRunning
+	state.Pid = initCommand.Process.Pid
+	state.Started = time.Now()
+	err = writeContainerState(*state)
+	if err != nil {
+		_ = initCommand.Process.Kill()
+		_ = initCommand.Wait()
+		state.Started = time.Time{}
+		return 1, err
+	}
+	if started != nil {
+		started(*state)
+	}
+
+	// The container ran out of memory if the kernel's OOM killer is what
+	// killed its init, not just some other process of the cgroup.
+	exitCode, err = waitForExit(initCommand)
+	if err == nil && exitCode == 128+int(syscall.SIGKILL) && cg != nil && cg.oomKills() > oomKills {
+		return exitCode, fmt.Errorf("container killed for exceeding its memory limit (out of memory)")
+	}
+
+	return exitCode, err
+}
+
+// containerCommand merges the image's Entrypoint and Cmd with the command
+// line the way Docker does: arguments replace Cmd, and overriding the
+// entrypoint drops the Cmd that went with it.
+func containerCommand(config ContainerConfig, entrypoint *string, args []string) []string {
+	command := config.Entrypoint
+	defaultArgs := config.Cmd
+	if entrypoint != nil {
+		command = nil
+		if *entrypoint != "" {
+			command = []string{*entrypoint}
+		}
+		defaultArgs = nil
+	}
+
+	if len(args) == 0 {
+		args = defaultArgs
+	}
+	return append(append([]string{}, command...), args...)
+}
+
+// startContainerCommand starts the init process of a container and hands it
+// spec. It returns once the container command is running, or with the exit
+// code to report when it could not be started. Unless nil, attach is called
+// with the pid of init before it gets its spec, to set up what has to be set
+// up from outside the container. The extra files of command, if any, are
+// passed after the spec and error pipes.
+func startContainerCommand(command *exec.Cmd, spec containerSpec, attach func(pid int) error) (int, error) {
+	specReader, specWriter, err := os.Pipe()
+	if err != nil {
+		return 1, err
+	}
+	defer specWriter.Close()
+	errorReader, errorWriter, err := os.Pipe()
+	if err != nil {
+		_ = specReader.Close()
+		return 1, err
+	}
+	defer errorReader.Close()
+
+	command.ExtraFiles = append([]*os.File{specReader, errorWriter}, command.ExtraFiles...)
+	err = command.Start()
+	_ = specReader.Close()
+	_ = errorWriter.Close()
+	if err != nil {
+		return 1, fmt.Errorf("error starting container: %w", err)
+	}
+
+	if attach != nil {
+		err = attach(command.Process.Pid)
+	}
+	if err == nil {
+		err = json.NewEncoder(specWriter).Encode(spec)
+	}
+	_ = specWriter.Close()
+	if err != nil {
+		_ = command.Process.Kill()
+		_ = command.Wait()
+		return 1, fmt.Errorf("error starting container: %w", err)
+	}
+
+	var initErr containerInitError
+	if json.NewDecoder(errorReader).Decode(&initErr) == nil {
+		_ = command.Wait()
+		return initErr.ExitCode, &initErr
 	}
 
 	return 0, nil
 }
 
-func determineExitCode(err error) int {
-	var exitError *exec.ExitError
+// execCommand runs a command in a running container, in all of its
+// namespaces, as its user, in its working directory and with its
+// environment. nsenter joins the namespaces, the user namespace first, which
+// a Go program cannot do as it is never single-threaded, and starts mydocker
+// there as containerExecPath, which joins the mount namespace last and starts
+// the command the way init does.
+func execCommand(state containerState, args []string) (int, error) {
+	if state.Status != containerRunning {
+		return 1, fmt.Errorf("container %s is not running", shortId(state.Id))
+	}
+
+	nsenterPath, err := exec.LookPath("nsenter")
+	if err != nil {
+		return 1, fmt.Errorf("exec requires nsenter from util-linux: %w", err)
+	}
+	binary, err := os.Open("/proc/self/exe")
+	if err != nil {
+		return 1, err
+	}
+	defer binary.Close()
+	nsPath := fmt.Sprintf("/proc/%d/ns", state.Pid)
+	mountNs, err := os.Open(path.Join(nsPath, "mnt"))
+	if err != nil {
+		return 1, fmt.Errorf("error opening namespace of container %s: %w", shortId(state.Id), err)
+	}
+	defer mountNs.Close()
+
+	nsenterArgs := []string{"nsenter", "--target", strconv.Itoa(state.Pid)}
+	// Entering the user namespace mydocker is in already is refused, as a
+	// way of gaining back capabilities.
+	userNs, _ := os.Readlink(path.Join(nsPath, "user"))
+	ownUserNs, _ := os.Readlink("/proc/self/ns/user")
+	if userNs != ownUserNs {
+		nsenterArgs = append(nsenterArgs, "--user")
+	}
+	nsenterArgs = append(nsenterArgs, "--ipc", "--uts", "--net", "--pid", "--cgroup", containerExecPath)
+
+	command := &exec.Cmd{
+		Path:       nsenterPath,
+		Args:       nsenterArgs,
+		Stdin:      os.Stdin,
+		Stdout:     os.Stdout,
+		Stderr:     os.Stderr,
+		ExtraFiles: []*os.File{binary, mountNs},
+	}
+
+	// The command is subject to the resource limits of the container.
+	cgroupDir, err := os.Open(path.Join(cgroupMountPath, cgroupParentName, state.Id))
+	if err == nil {
+		defer cgroupDir.Close()
+		command.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: int(cgroupDir.Fd())}
+	}
+
+	spec := containerSpec{
+		Args:       args,
+		Env:        state.Env,
+		WorkingDir: state.WorkingDir,
+		User:       state.User,
+	}
+	exitCode, err := startContainerCommand(command, spec, nil)
+	if err != nil {
+		return exitCode, err
+	}
+
+	return waitForExit(command)
+}
 
+// waitForExit waits for a started command and returns its exit code. A
+// command exiting unsuccessfully is not an error.
+func waitForExit(command *exec.Cmd) (int, error) {
+	err := command.Wait()
+	var exitError *exec.ExitError
 	if errors.As(err, &exitError) {
-		return exitError.ExitCode()
-	} else {
-		return 1
+		return exitCode(exitError), nil
+	}
+	if err != nil {
+		return 1, err
+	}
+
+	return 0, nil
+}
+
+// exitCode returns the exit code of a command the way a shell reports it,
+// 128 plus the signal number for commands killed by a signal.
+func exitCode(exitError *exec.ExitError) int {
+	if status, ok := exitError.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
 	}
+	return exitError.ExitCode()
 }
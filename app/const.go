@@ -1,12 +1,40 @@
 package main
 
+import "time"
+
 const (
-	authenticationUrl        = "https://auth.docker.io/token?service=registry.docker.io&scope=repository:%s:pull"
-	blobUrl                  = "https://registry.hub.docker.com/v2/%s/blobs/%s"
-	manifestUrl              = "https://registry.hub.docker.com/v2/%s/manifests/%s"
-	storagePathPrefix        = "/var/lib/mydocker/overlay2"
-	sandboxPathPrefix        = storagePathPrefix + "/sandbox"
-	imageLayerPathPrefix     = storagePathPrefix + "/image"
-	v1ManifestLayerMediaType = "application/vnd.docker.container.image.rootfs.diff.tar.gzip"
-	imageIndexMediaType      = "application/vnd.oci.image.index.v1+json"
+	version                       = "0.1.0"
+	defaultRegistryHost           = "registry-1.docker.io"
+	registryPingUrl               = "%s/v2/"
+	blobUrl                       = "%s/v2/%s/blobs/%s"
+	manifestUrl                   = "%s/v2/%s/manifests/%s"
+	defaultTokenExpiry            = 60
+	tokenClientId                 = "mydocker"
+	defaultMaxConcurrentDownloads = 3
+	maxDownloadAttempts           = 3
+	downloadRetryDelay            = time.Second
+	defaultStoragePath            = "/var/lib/mydocker/overlay2"
+	rootlessStorageDir            = "mydocker/overlay2"
+	v1ManifestLayerMediaType      = "application/vnd.docker.container.image.rootfs.diff.tar.gzip"
+	dockerLayerMediaType          = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	imageIndexMediaType           = "application/vnd.oci.image.index.v1+json"
+	manifestAcceptHeader          = imageIndexMediaType + ", " +
+		"application/vnd.docker.distribution.manifest.list.v2+json, " +
+		"application/vnd.oci.image.manifest.v1+json, " +
+		"application/vnd.docker.distribution.manifest.v2+json, " +
+		"application/vnd.docker.distribution.manifest.v1+prettyjws"
+)
+
+// The store lives under $XDG_DATA_HOME in rootless mode.
+var (
+	storagePathPrefix   = storageRoot()
+	sandboxPathPrefix   = storagePathPrefix + "/sandbox"
+	containerPathPrefix = storagePathPrefix + "/containers"
+	blobPathPrefix      = storagePathPrefix + "/blobs"
+	layerPathPrefix     = storagePathPrefix + "/layers"
+	imagePathPrefix     = storagePathPrefix + "/images"
+	diffIdPathPrefix    = storagePathPrefix + "/distribution/diffid-by-digest"
+	storeLockPath       = storagePathPrefix + "/lock"
+	ingestPathPrefix    = storagePathPrefix + "/ingest"
+	networkPathPrefix   = storagePathPrefix + "/network"
 )
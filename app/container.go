@@ -0,0 +1,342 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Every container has a record of its state, kept up to date by the process
+// running it: mydocker run itself or, for a detached container, its
+// supervisor. That process holds the container's lock until it has recorded
+// the container's exit. Exited containers are kept, sandbox included, until
+// they are removed, unless run with --rm. A container's ID is that of its
+// sandbox without the digest algorithm.
+//
+//	containers/<id>/state.json     the containerState
+//	containers/<id>/lock
+//	containers/<id>/container.log  output of a detached container
+
+const (
+	containerCreated = "created"
+	containerRunning = "running"
+	containerExited  = "exited"
+)
+
+// lostContainerExitCode is reported for containers whose exit was never
+// recorded, because the process running them went away first.
+const lostContainerExitCode = 255
+
+// containerPollInterval is how often the state of a container is checked
+// while waiting for it to exit.
+const containerPollInterval = 100 * time.Millisecond
+
+type containerState struct {
+	Id      string   `json:"id"`
+	Image   string   `json:"image"`
+	ImageId string   `json:"imageId"`
+	Command []string `json:"command"`
+	// Env, User and WorkingDir are those the command runs with, which
+	// exec'd commands get too.
+	Env        []string `json:"env,omitempty"`
+	User       string   `json:"user,omitempty"`
+	WorkingDir string   `json:"workingDir,omitempty"`
+	Status     string   `json:"status"`
+	// Pid is the host PID of the container's init process while it runs.
+	Pid      int           `json:"pid,omitempty"`
+	ExitCode int           `json:"exitCode"`
+	Error    string        `json:"error,omitempty"`
+	Ports    []portMapping `json:"ports,omitempty"`
+	Created  time.Time     `json:"created"`
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished"`
+}
+
+// newContainerState returns the state of a new container of the image.
+func newContainerState(image, imageId string) (containerState, error) {
+	id, err := GenerateRandomSHA256()
+	if err != nil {
+		return containerState{}, fmt.Errorf("error generating random container id: %w", err)
+	}
+
+	return containerState{Id: id, Image: image, ImageId: imageId, Created: time.Now()}, nil
+}
+
+func containerDir(id string) string {
+	return path.Join(containerPathPrefix, id)
+}
+
+func containerLogPath(id string) string {
+	return path.Join(containerDir(id), "container.log")
+}
+
+func containerLockPath(id string) string {
+	return path.Join(containerDir(id), "lock")
+}
+
+// readContainerState reads the state of a container. A container left
+// running or being created by a process that is gone, and whose init is gone
+// too, is reported as exited.
+func readContainerState(id string) (containerState, error) {
+	var state containerState
+	err := readJSONFile(path.Join(containerDir(id), "state.json"), &state)
+	if err != nil {
+		return state, err
+	}
+
+	if state.Status != containerExited && !containerLocked(id) && !processExists(state.Pid) {
+		state.Status = containerExited
+		state.Pid = 0
+		state.ExitCode = lostContainerExitCode
+		state.Error = "container exited without mydocker recording it"
+	}
+	return state, nil
+}
+
+func writeContainerState(state containerState) error {
+	err := writeJSONFile(path.Join(containerDir(state.Id), "state.json"), state)
+	if err != nil {
+		return fmt.Errorf("error recording container state: %w", err)
+	}
+	return nil
+}
+
+func removeContainerState(id string) {
+	err := os.RemoveAll(containerDir(id))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error removing container state %s: %v\n", id, err)
+	}
+}
+
+// lockContainer takes the lock of a container for the process running it.
+func lockContainer(id string) (func(), error) {
+	err := os.MkdirAll(containerDir(id), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating container directory: %w", err)
+	}
+
+	file, err := os.OpenFile(containerLockPath(id), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening container lock: %w", err)
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("error locking container: %w", err)
+	}
+
+	return func() {
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		_ = file.Close()
+	}, nil
+}
+
+// containerLocked reports whether a process is running the container.
+func containerLocked(id string) bool {
+	file, err := os.Open(containerLockPath(id))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	return errors.Is(syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB), syscall.EWOULDBLOCK)
+}
+
+func processExists(pid int) bool {
+	return pid > 0 && !errors.Is(syscall.Kill(pid, 0), syscall.ESRCH)
+}
+
+// listContainers returns the state of all containers, newest first.
+func listContainers() ([]containerState, error) {
+	entries, err := os.ReadDir(containerPathPrefix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading container path: %w", err)
+	}
+
+	var containers []containerState
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		state, err := readContainerState(entry.Name())
+		// The container may be gone by now, or its state not yet written.
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading container %s: %w", entry.Name(), err)
+		}
+		containers = append(containers, state)
+	}
+
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].Created.After(containers[j].Created)
+	})
+
+	return containers, nil
+}
+
+// findContainer returns the state of the container whose ID (with or
+// without the "sha256:" prefix of its sandbox) starts with idPrefix.
+func findContainer(idPrefix string) (containerState, error) {
+	containers, err := listContainers()
+	if err != nil {
+		return containerState{}, err
+	}
+
+	var matches []containerState
+	for _, container := range containers {
+		if strings.HasPrefix(container.Id, trimDigestAlgorithm(idPrefix)) {
+			matches = append(matches, container)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return containerState{}, fmt.Errorf("no such container: %s", idPrefix)
+	case 1:
+		return matches[0], nil
+	default:
+		return containerState{}, fmt.Errorf("container id prefix %s is ambiguous", idPrefix)
+	}
+}
+
+var signalNames = map[string]syscall.Signal{
+	"ABRT": syscall.SIGABRT, "ALRM": syscall.SIGALRM, "BUS": syscall.SIGBUS,
+	"CHLD": syscall.SIGCHLD, "CONT": syscall.SIGCONT, "FPE": syscall.SIGFPE,
+	"HUP": syscall.SIGHUP, "ILL": syscall.SIGILL, "INT": syscall.SIGINT,
+	"IO": syscall.SIGIO, "KILL": syscall.SIGKILL, "PIPE": syscall.SIGPIPE,
+	"PROF": syscall.SIGPROF, "PWR": syscall.SIGPWR, "QUIT": syscall.SIGQUIT,
+	"SEGV": syscall.SIGSEGV, "STOP": syscall.SIGSTOP, "SYS": syscall.SIGSYS,
+	"TERM": syscall.SIGTERM, "TRAP": syscall.SIGTRAP, "TSTP": syscall.SIGTSTP,
+	"TTIN": syscall.SIGTTIN, "TTOU": syscall.SIGTTOU, "URG": syscall.SIGURG,
+	"USR1": syscall.SIGUSR1, "USR2": syscall.SIGUSR2, "VTALRM": syscall.SIGVTALRM,
+	"WINCH": syscall.SIGWINCH, "XCPU": syscall.SIGXCPU, "XFSZ": syscall.SIGXFSZ,
+}
+
+// parseSignal parses a signal given by name, with or without the SIG
+// prefix, or by number.
+func parseSignal(value string) (syscall.Signal, error) {
+	if number, err := strconv.Atoi(value); err == nil {
+		if number < 1 || number > 64 {
+			return 0, fmt.Errorf("invalid signal: %s", value)
+		}
+		return syscall.Signal(number), nil
+	}
+
+	sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(value), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("invalid signal: %s", value)
+	}
+	return sig, nil
+}
+
+// signalContainer sends sig to the init process of a running container.
+func signalContainer(state containerState, sig syscall.Signal) error {
+	if state.Status != containerRunning {
+		return fmt.Errorf("container %s is not running", shortId(state.Id))
+	}
+
+	err := syscall.Kill(state.Pid, sig)
+	if errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("container %s is not running", shortId(state.Id))
+	}
+	if err != nil {
+		return fmt.Errorf("error signaling container %s: %w", shortId(state.Id), err)
+	}
+	return nil
+}
+
+// waitForContainer waits for a container to exit, or for the deadline
+// unless it is zero, and returns its last known state. Containers run with
+// --rm end up not existing.
+func waitForContainer(id string, deadline time.Time) (containerState, error) {
+	for {
+		state, err := readContainerState(id)
+		if err != nil || state.Status == containerExited {
+			return state, err
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return state, nil
+		}
+		time.Sleep(containerPollInterval)
+	}
+}
+
+// stopContainer asks a running container to exit with SIGTERM and kills it
+// if it has not after timeout.
+func stopContainer(state containerState, timeout time.Duration) error {
+	if state.Status != containerRunning {
+		return nil
+	}
+
+	err := signalContainer(state, syscall.SIGTERM)
+	if err == nil {
+		state, err = waitForContainer(state.Id, time.Now().Add(timeout))
+	}
+	if err == nil && state.Status != containerExited {
+		err = signalContainer(state, syscall.SIGKILL)
+		if err == nil {
+			_, err = waitForContainer(state.Id, time.Time{})
+		}
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// removeContainer removes a container's sandbox and state. Running
+// containers are killed first when force is set. Containers still being
+// created have nothing to kill yet and are removed like exited ones.
+func removeContainer(state containerState, force bool) error {
+	if state.Status == containerRunning {
+		if !force {
+			return fmt.Errorf("cannot remove running container %s: stop the container before attempting removal or force remove", shortId(state.Id))
+		}
+		err := signalContainer(state, syscall.SIGKILL)
+		if err == nil {
+			_, err = waitForContainer(state.Id, time.Time{})
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	sandboxDir := containerSandboxPath(state.Id)
+	if unmountSandbox(sandboxDir) != nil {
+		return fmt.Errorf("error removing container %s: sandbox is still mounted", shortId(state.Id))
+	}
+	err := os.RemoveAll(sandboxDir)
+	if err == nil {
+		err = os.RemoveAll(containerDir(state.Id))
+	}
+	if err != nil {
+		return fmt.Errorf("error removing container %s: %w", shortId(state.Id), err)
+	}
+	return nil
+}
+
+// describePorts lists the published ports of a container the way ps shows
+// them, like 0.0.0.0:8080->80/tcp.
+func describePorts(ports []portMapping) string {
+	var descriptions []string
+	for _, mapping := range ports {
+		host := "0.0.0.0"
+		if mapping.HostIP != nil {
+			host = mapping.HostIP.String()
+		}
+		descriptions = append(descriptions, fmt.Sprintf("%s:%d->%d/%s", host, mapping.HostPort, mapping.ContainerPort, mapping.Protocol))
+	}
+	return strings.Join(descriptions, ", ")
+}
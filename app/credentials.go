@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	dockerHubAuthKey      = "https://index.docker.io/v1/"
+	credentialHelperToken = "<token>"
+)
+
+type registryCredentials struct {
+	Username string
+	Password string
+	// IdentityToken is an OAuth2 refresh token that is exchanged for an
+	// access token instead of sending Username and Password.
+	IdentityToken string
+}
+
+func (c registryCredentials) isZero() bool {
+	return c.Username == "" && c.Password == "" && c.IdentityToken == ""
+}
+
+// dockerConfigFile is the layout of ~/.docker/config.json. The credentials
+// written by "mydocker login" use the same layout in their own file.
+type dockerConfigFile struct {
+	Auths       map[string]dockerAuthEntry `json:"auths"`
+	CredsStore  string                     `json:"credsStore,omitempty"`
+	CredHelpers map[string]string          `json:"credHelpers,omitempty"`
+}
+
+type dockerAuthEntry struct {
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+type credentialHelperResponse struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+func credentialsFilePath() (string, error) {
+	if configDir := os.Getenv("MYDOCKER_CONFIG"); configDir != "" {
+		return filepath.Join(configDir, "config.json"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error locating home directory: %w", err)
+	}
+	return filepath.Join(home, ".mydocker", "config.json"), nil
+}
+
+func dockerConfigFilePath() (string, error) {
+	if configDir := os.Getenv("DOCKER_CONFIG"); configDir != "" {
+		return filepath.Join(configDir, "config.json"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error locating home directory: %w", err)
+	}
+	return filepath.Join(home, ".docker", "config.json"), nil
+}
+
+func readConfigFile(configPath string) (dockerConfigFile, error) {
+	config := dockerConfigFile{Auths: map[string]dockerAuthEntry{}}
+
+	data, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, fmt.Errorf("error reading %s: %w", configPath, err)
+	}
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("error parsing %s: %w", configPath, err)
+	}
+	if config.Auths == nil {
+		config.Auths = map[string]dockerAuthEntry{}
+	}
+
+	return config, nil
+}
+
+func writeConfigFile(configPath string, config dockerConfigFile) error {
+	err := os.MkdirAll(filepath.Dir(configPath), 0700)
+	if err != nil {
+		return fmt.Errorf("error creating config directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return fmt.Errorf("error encoding credentials: %w", err)
+	}
+
+	tempPath := configPath + ".tmp"
+	err = os.WriteFile(tempPath, append(data, '\n'), 0600)
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", tempPath, err)
+	}
+
+	return os.Rename(tempPath, configPath)
+}
+
+// registryAuthKey returns the key credentials for registry are stored under.
+// Docker Hub keeps its historical v1 index URL so that the files stay
+// interchangeable with the docker CLI.
+func registryAuthKey(registry string) string {
+	if registry == defaultRegistry {
+		return dockerHubAuthKey
+	}
+	return registry
+}
+
+// normalizeAuthKey reduces the spellings found in config files ("host",
+// "https://host", "https://host/v1/", ...) to a registry host.
+func normalizeAuthKey(key string) string {
+	host := key
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	host, _, _ = strings.Cut(host, "/")
+
+	switch host {
+	case legacyDefaultDomain, defaultRegistryHost, defaultRegistry:
+		return defaultRegistry
+	}
+	return host
+}
+
+// lookupCredentials returns the credentials for registry, preferring those
+// stored by "mydocker login" and falling back to the docker CLI
+// configuration, including its credential helpers. It returns zero
+// credentials when none are configured.
+func lookupCredentials(registry string) (registryCredentials, error) {
+	configPath, err := credentialsFilePath()
+	if err != nil {
+		return registryCredentials{}, err
+	}
+	config, err := readConfigFile(configPath)
+	if err != nil {
+		return registryCredentials{}, err
+	}
+	if creds, ok, err := findAuthEntry(config, registry); ok || err != nil {
+		return creds, err
+	}
+
+	dockerConfigPath, err := dockerConfigFilePath()
+	if err != nil {
+		return registryCredentials{}, err
+	}
+	dockerConfig, err := readConfigFile(dockerConfigPath)
+	if err != nil {
+		return registryCredentials{}, err
+	}
+
+	if helper := dockerConfig.CredHelpers[registry]; helper != "" {
+		return credentialsFromHelper(helper, registry)
+	}
+	for key, helper := range dockerConfig.CredHelpers {
+		if normalizeAuthKey(key) == registry {
+			return credentialsFromHelper(helper, registry)
+		}
+	}
+	if dockerConfig.CredsStore != "" {
+		return credentialsFromHelper(dockerConfig.CredsStore, registry)
+	}
+
+	creds, _, err := findAuthEntry(dockerConfig, registry)
+	return creds, err
+}
+
+func findAuthEntry(config dockerConfigFile, registry string) (registryCredentials, bool, error) {
+	entry, ok := config.Auths[registryAuthKey(registry)]
+	if !ok {
+		for key, candidate := range config.Auths {
+			if normalizeAuthKey(key) == registry {
+				entry, ok = candidate, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return registryCredentials{}, false, nil
+	}
+
+	creds := registryCredentials{
+		Username:      entry.Username,
+		Password:      entry.Password,
+		IdentityToken: entry.IdentityToken,
+	}
+	if entry.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return creds, true, fmt.Errorf("invalid auth entry for %s: %w", registry, err)
+		}
+		username, password, found := strings.Cut(string(decoded), ":")
+		if !found {
+			return creds, true, fmt.Errorf("invalid auth entry for %s: missing password", registry)
+		}
+		creds.Username, creds.Password = username, password
+	}
+
+	return creds, !creds.isZero(), nil
+}
+
+// credentialsFromHelper runs "docker-credential-<helper> get" for registry.
+func credentialsFromHelper(helper, registry string) (registryCredentials, error) {
+	var stdout, stderr bytes.Buffer
+
+	command := exec.Command("docker-credential-"+helper, "get")
+	command.Stdin = strings.NewReader(registryAuthKey(registry))
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+
+	err := command.Run()
+	if err != nil {
+		output := strings.TrimSpace(stdout.String() + stderr.String())
+		var exitError *exec.ExitError
+		if errors.As(err, &exitError) && strings.Contains(strings.ToLower(output), "credentials not found") {
+			return registryCredentials{}, nil
+		}
+		return registryCredentials{}, fmt.Errorf("error running credential helper docker-credential-%s: %w: %s", helper, err, output)
+	}
+
+	var response credentialHelperResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return registryCredentials{}, fmt.Errorf("error parsing output of docker-credential-%s: %w", helper, err)
+	}
+
+	if response.Username == credentialHelperToken {
+		return registryCredentials{IdentityToken: response.Secret}, nil
+	}
+	return registryCredentials{Username: response.Username, Password: response.Secret}, nil
+}
+
+func storeCredentials(registry string, creds registryCredentials) error {
+	configPath, err := credentialsFilePath()
+	if err != nil {
+		return err
+	}
+	config, err := readConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	config.Auths[registryAuthKey(registry)] = dockerAuthEntry{
+		Auth: base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Password)),
+	}
+
+	return writeConfigFile(configPath, config)
+}
+
+// removeCredentials deletes the stored credentials for registry and reports
+// whether there were any.
+func removeCredentials(registry string) (bool, error) {
+	configPath, err := credentialsFilePath()
+	if err != nil {
+		return false, err
+	}
+	config, err := readConfigFile(configPath)
+	if err != nil {
+		return false, err
+	}
+
+	removed := false
+	for key := range config.Auths {
+		if normalizeAuthKey(key) == registry {
+			delete(config.Auths, key)
+			removed = true
+		}
+	}
+	if !removed {
+		return false, nil
+	}
+
+	return true, writeConfigFile(configPath, config)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a config.json with content into a new directory and
+// points the environment variable variable at it.
+func writeConfig(t *testing.T, variable, content string) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv(variable, dir)
+	if content == "" {
+		return
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// installCredentialHelpers puts a docker-credential-<name> script on PATH for
+// every name in scripts. A script runs with the server URL it was asked
+// about in $server.
+func installCredentialHelpers(t *testing.T, scripts map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, script := range scripts {
+		content := "#!/bin/sh\n[ \"$1\" = get ] || exit 2\nread -r server\n" + script + "\n"
+		if err := os.WriteFile(filepath.Join(dir, "docker-credential-"+name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func basicAuth(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
+
+func TestLookupCredentials(t *testing.T) {
+	tests := []struct {
+		name           string
+		registry       string
+		mydockerConfig string
+		dockerConfig   string
+		helpers        map[string]string
+		want           registryCredentials
+		// err is part of the error message, empty if the lookup succeeds.
+		err string
+	}{
+		{
+			name:     "nothing configured",
+			registry: "registry.example.com",
+		},
+		{
+			name:           "mydocker login",
+			registry:       "registry.example.com",
+			mydockerConfig: `{"auths":{"registry.example.com":{"auth":"` + basicAuth("me", "secret") + `"}}}`,
+			want:           registryCredentials{Username: "me", Password: "secret"},
+		},
+		{
+			name:           "mydocker config over docker config",
+			registry:       "registry.example.com",
+			mydockerConfig: `{"auths":{"registry.example.com":{"auth":"` + basicAuth("mydocker", "secret") + `"}}}`,
+			dockerConfig:   `{"auths":{"registry.example.com":{"auth":"` + basicAuth("docker", "secret") + `"}}}`,
+			want:           registryCredentials{Username: "mydocker", Password: "secret"},
+		},
+		{
+			name:         "docker config auths",
+			registry:     "registry.example.com",
+			dockerConfig: `{"auths":{"https://registry.example.com/v1/":{"username":"docker","password":"secret"}}}`,
+			want:         registryCredentials{Username: "docker", Password: "secret"},
+		},
+		{
+			name:         "Docker Hub under its index URL",
+			registry:     defaultRegistry,
+			dockerConfig: `{"auths":{"https://index.docker.io/v1/":{"auth":"` + basicAuth("hub", "secret") + `"}}}`,
+			want:         registryCredentials{Username: "hub", Password: "secret"},
+		},
+		{
+			name:         "identity token in auths",
+			registry:     "registry.example.com",
+			dockerConfig: `{"auths":{"registry.example.com":{"identitytoken":"refresh-token"}}}`,
+			want:         registryCredentials{IdentityToken: "refresh-token"},
+		},
+		{
+			name:         "auth without a password",
+			registry:     "registry.example.com",
+			dockerConfig: `{"auths":{"registry.example.com":{"auth":"` + base64.StdEncoding.EncodeToString([]byte("me")) + `"}}}`,
+			err:          "invalid auth entry for registry.example.com: missing password",
+		},
+		{
+			name:         "credential helper",
+			registry:     "registry.example.com",
+			dockerConfig: `{"credHelpers":{"registry.example.com":"test"}}`,
+			helpers: map[string]string{
+				"test": `echo "{\"ServerURL\":\"$server\",\"Username\":\"helper-$server\",\"Secret\":\"secret\"}"`,
+			},
+			want: registryCredentials{Username: "helper-registry.example.com", Password: "secret"},
+		},
+		{
+			name:         "credHelpers over credsStore",
+			registry:     "registry.example.com",
+			dockerConfig: `{"credsStore":"store","credHelpers":{"https://registry.example.com":"test"}}`,
+			helpers: map[string]string{
+				"store": `echo '{"Username":"store","Secret":"secret"}'`,
+				"test":  `echo '{"Username":"helper","Secret":"secret"}'`,
+			},
+			want: registryCredentials{Username: "helper", Password: "secret"},
+		},
+		{
+			name:         "credsStore over auths",
+			registry:     defaultRegistry,
+			dockerConfig: `{"credsStore":"store","auths":{"https://index.docker.io/v1/":{"auth":"` + basicAuth("auths", "secret") + `"}}}`,
+			helpers: map[string]string{
+				"store": `[ "$server" = https://index.docker.io/v1/ ] && echo '{"Username":"store","Secret":"secret"}'`,
+			},
+			want: registryCredentials{Username: "store", Password: "secret"},
+		},
+		{
+			name:         "identity token from a helper",
+			registry:     "registry.example.com",
+			dockerConfig: `{"credsStore":"store"}`,
+			helpers: map[string]string{
+				"store": `echo '{"Username":"<token>","Secret":"refresh-token"}'`,
+			},
+			want: registryCredentials{IdentityToken: "refresh-token"},
+		},
+		{
+			name:         "credentials not found",
+			registry:     "registry.example.com",
+			dockerConfig: `{"credsStore":"store"}`,
+			helpers: map[string]string{
+				"store": `echo "credentials not found in native keychain"; exit 1`,
+			},
+		},
+		{
+			name:         "failing helper",
+			registry:     "registry.example.com",
+			dockerConfig: `{"credsStore":"store"}`,
+			helpers: map[string]string{
+				"store": `echo "keychain is locked" >&2; exit 1`,
+			},
+			err: "error running credential helper docker-credential-store: exit status 1: keychain is locked",
+		},
+		{
+			name:         "missing helper",
+			registry:     "registry.example.com",
+			dockerConfig: `{"credsStore":"missing"}`,
+			err:          "error running credential helper docker-credential-missing",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writeConfig(t, "MYDOCKER_CONFIG", test.mydockerConfig)
+			writeConfig(t, "DOCKER_CONFIG", test.dockerConfig)
+			installCredentialHelpers(t, test.helpers)
+
+			creds, err := lookupCredentials(test.registry)
+			switch {
+			case test.err == "" && err != nil:
+				t.Fatalf("err = %v, want none", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Fatalf("err = %v, want one containing %q", err, test.err)
+			}
+			if creds != test.want {
+				t.Errorf("credentials = %+v, want %+v", creds, test.want)
+			}
+		})
+	}
+}
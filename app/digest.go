@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// errContentVerification marks content that does not match its digest or
+// size, as opposed to a failed transfer.
+var errContentVerification = errors.New("content verification failed")
+
+// newDigestHash returns a hash for the algorithm part of digest, e.g. the
+// "sha256" of "sha256:abc...".
+func newDigestHash(digest string) (hash.Hash, error) {
+	algorithm, _, found := strings.Cut(digest, ":")
+	if !found {
+		return nil, fmt.Errorf("invalid digest %q", digest)
+	}
+
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+}
+
+// computeDigest hashes data with the same algorithm as like and returns the
+// resulting digest string.
+func computeDigest(like string, data []byte) (string, error) {
+	h, err := newDigestHash(like)
+	if err != nil {
+		return "", err
+	}
+	h.Write(data)
+
+	algorithm, _, _ := strings.Cut(like, ":")
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyDigest checks that data hashes to expected.
+func verifyDigest(expected string, data []byte) error {
+	actual, err := computeDigest(expected, data)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("%w: digest mismatch: expected %s, got %s", errContentVerification, expected, actual)
+	}
+	return nil
+}
+
+// blobVerifier checks that the bytes written to it hash to an expected
+// digest and, when the expected size is positive, that there are exactly that
+// many of them.
+type blobVerifier struct {
+	hash     hash.Hash
+	expected string
+	size     int64
+	written  int64
+}
+
+func newBlobVerifier(digest string, size int64) (*blobVerifier, error) {
+	h, err := newDigestHash(digest)
+	if err != nil {
+		return nil, err
+	}
+	return &blobVerifier{hash: h, expected: digest, size: size}, nil
+}
+
+func (v *blobVerifier) Write(b []byte) (int, error) {
+	v.written += int64(len(b))
+	if v.size > 0 && v.written > v.size {
+		return 0, fmt.Errorf("%w: size mismatch: expected %d bytes, got more", errContentVerification, v.size)
+	}
+	return v.hash.Write(b)
+}
+
+// limit caps r one byte past the remainder of the expected size, enough for
+// Write to notice an oversized blob without reading an unbounded amount of it.
+func (v *blobVerifier) limit(r io.Reader) io.Reader {
+	if v.size <= 0 {
+		return r
+	}
+	return io.LimitReader(r, v.size-v.written+1)
+}
+
+func (v *blobVerifier) verify() error {
+	if v.size > 0 && v.written != v.size {
+		return fmt.Errorf("%w: size mismatch: expected %d bytes, got %d", errContentVerification, v.size, v.written)
+	}
+
+	algorithm, _, _ := strings.Cut(v.expected, ":")
+	actual := algorithm + ":" + hex.EncodeToString(v.hash.Sum(nil))
+	if actual != v.expected {
+		return fmt.Errorf("%w: digest mismatch: expected %s, got %s", errContentVerification, v.expected, actual)
+	}
+
+	return nil
+}
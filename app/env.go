@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// defaultPath is the PATH of containers whose image sets none.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// mergeEnv returns the environment made of the variables of each of the lists
+// in turn, where a later variable replaces an earlier one with the same name
+// in place.
+func mergeEnv(lists ...[]string) []string {
+	var env []string
+	index := make(map[string]int)
+	for _, list := range lists {
+		for _, variable := range list {
+			key, _, _ := strings.Cut(variable, "=")
+			if i, ok := index[key]; ok {
+				env[i] = variable
+				continue
+			}
+			index[key] = len(env)
+			env = append(env, variable)
+		}
+	}
+	return env
+}
+
+// parseEnvVariable parses a variable given to -e or in an env file. A bare
+// KEY passes the variable of that name through from the host environment;
+// it is dropped when the host has no such variable.
+func parseEnvVariable(value string) (string, bool, error) {
+	key, _, hasValue := strings.Cut(value, "=")
+	if key == "" || strings.ContainsAny(key, " \t") {
+		return "", false, fmt.Errorf("invalid environment variable %q", value)
+	}
+	if hasValue {
+		return value, true, nil
+	}
+
+	hostValue, ok := os.LookupEnv(key)
+	return key + "=" + hostValue, ok, nil
+}
+
+// readEnvFile reads the variables of an env file: one KEY=VALUE or KEY per
+// line, with blank lines and lines starting with # ignored. Values are taken
+// literally, quotes included.
+func readEnvFile(filePath string) ([]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var env []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimLeft(scanner.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		variable, ok, err := parseEnvVariable(line)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", filePath, err)
+		}
+		if ok {
+			env = append(env, variable)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", filePath, err)
+	}
+
+	return env, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+)
+
+// Containers get /etc/hostname, /etc/hosts and /etc/resolv.conf generated
+// for them in the sandbox directory and bind mounted over those of the
+// image, which know nothing of the container's name, address or DNS.
+
+// defaultNameservers replace the host's when all of those are local, and so
+// unreachable from a network namespace of its own.
+var defaultNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+const hostGatewayName = "host-gateway"
+
+// The host's files the container's are based on.
+var (
+	hostHostsPath      = "/etc/hosts"
+	hostResolvConfPath = "/etc/resolv.conf"
+)
+
+// hostEntry is an extra /etc/hosts entry given with --add-host. Its address
+// may be hostGatewayName, the address of the host on the bridge network.
+type hostEntry struct {
+	Name    string
+	Address string
+}
+
+// parseHostEntry parses a --add-host value of the form HOST:IP or HOST=IP.
+func parseHostEntry(value string) (hostEntry, error) {
+	separator := strings.IndexAny(value, ":=")
+	if separator <= 0 {
+		return hostEntry{}, fmt.Errorf("invalid host entry %q: expected HOST:IP", value)
+	}
+
+	entry := hostEntry{Name: value[:separator], Address: strings.Trim(value[separator+1:], "[]")}
+	if entry.Address != hostGatewayName && net.ParseIP(entry.Address) == nil {
+		return hostEntry{}, fmt.Errorf("invalid IP address in host entry %q", value)
+	}
+	return entry, nil
+}
+
+// dnsConfig is the DNS configuration of a container; empty fields are taken
+// from the host.
+type dnsConfig struct {
+	Servers    []string
+	Search     []string
+	ExtraHosts []hostEntry
+}
+
+// containerBindMount mounts the host path Source at Target in the rootfs.
+type containerBindMount struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+// writeEtcFiles writes the files of a container with the given hostname and
+// network into its sandbox directory and returns the mounts for them.
+func writeEtcFiles(sandboxDir, hostname string, network containerNetwork, dns dnsConfig) ([]containerBindMount, error) {
+	hosts, err := hostsFile(hostname, network, dns.ExtraHosts)
+	if err != nil {
+		return nil, err
+	}
+	resolvConf, err := resolvConfFile(network, dns)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{"hostname", []byte(hostname + "\n")},
+		{"hosts", hosts},
+		{"resolv.conf", resolvConf},
+	}
+
+	var mounts []containerBindMount
+	for _, file := range files {
+		source := path.Join(sandboxDir, file.name)
+		err = os.WriteFile(source, file.content, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("error writing /etc/%s: %w", file.name, err)
+		}
+		mounts = append(mounts, containerBindMount{Source: source, Target: path.Join("/etc", file.name)})
+	}
+
+	return mounts, nil
+}
+
+// hostsFile returns the /etc/hosts of a container: the host's own with the
+// host network, and otherwise the usual localhost entries and one for the
+// container itself.
+func hostsFile(hostname string, network containerNetwork, extraHosts []hostEntry) ([]byte, error) {
+	var hosts bytes.Buffer
+	if network.Mode == networkHost {
+		data, err := os.ReadFile(hostHostsPath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error reading %s: %w", hostHostsPath, err)
+		}
+		hosts.Write(data)
+	} else {
+		hosts.WriteString("127.0.0.1\tlocalhost\n")
+		hosts.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+		hosts.WriteString("fe00::0\tip6-localnet\n")
+		hosts.WriteString("ff00::0\tip6-mcastprefix\n")
+		hosts.WriteString("ff02::1\tip6-allnodes\n")
+		hosts.WriteString("ff02::2\tip6-allrouters\n")
+	}
+
+	for _, entry := range extraHosts {
+		address := entry.Address
+		if address == hostGatewayName {
+			_, gateway := bridgeNetwork()
+			address = gateway.String()
+		}
+		fmt.Fprintf(&hosts, "%s\t%s\n", address, entry.Name)
+	}
+
+	if address, _, found := strings.Cut(network.Address, "/"); found {
+		fmt.Fprintf(&hosts, "%s\t%s\n", address, hostname)
+	}
+
+	return hosts.Bytes(), nil
+}
+
+// resolvConfFile returns the /etc/resolv.conf of a container, based on the
+// host's. Outside the host network, local nameservers such as a caching
+// resolver on 127.0.0.53 cannot be reached and are dropped.
+func resolvConfFile(network containerNetwork, dns dnsConfig) ([]byte, error) {
+	var nameservers, search, others []string
+
+	file, err := os.Open(hostResolvConfPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading %s: %w", hostResolvConfPath, err)
+	}
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			fields := strings.Fields(line)
+			switch {
+			case len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";"):
+			case fields[0] == "nameserver" && len(fields) > 1:
+				ip := net.ParseIP(fields[1])
+				if network.Mode == networkHost || ip == nil || !ip.IsLoopback() {
+					nameservers = append(nameservers, fields[1])
+				}
+			case fields[0] == "search" || fields[0] == "domain":
+				search = fields[1:]
+			default:
+				others = append(others, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", hostResolvConfPath, err)
+		}
+	}
+
+	if len(dns.Servers) > 0 {
+		nameservers = dns.Servers
+	}
+	if len(nameservers) == 0 && network.Mode != networkNone {
+		nameservers = defaultNameservers
+	}
+	if len(dns.Search) > 0 {
+		search = dns.Search
+	}
+	// A search domain of "." clears the search list.
+	if len(search) == 1 && search[0] == "." {
+		search = nil
+	}
+
+	var resolvConf bytes.Buffer
+	for _, nameserver := range nameservers {
+		fmt.Fprintf(&resolvConf, "nameserver %s\n", nameserver)
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&resolvConf, "search %s\n", strings.Join(search, " "))
+	}
+	for _, line := range others {
+		fmt.Fprintln(&resolvConf, line)
+	}
+
+	return resolvConf.Bytes(), nil
+}
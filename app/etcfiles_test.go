@@ -0,0 +1,194 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useHostFile points *hostPath at a file with content for the test, or at a
+// missing file if content is empty.
+func useHostFile(t *testing.T, hostPath *string, content string) {
+	t.Helper()
+	saved := *hostPath
+	t.Cleanup(func() { *hostPath = saved })
+
+	*hostPath = filepath.Join(t.TempDir(), filepath.Base(saved))
+	if content == "" {
+		return
+	}
+	if err := os.WriteFile(*hostPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolvConfFile(t *testing.T) {
+	bridge := containerNetwork{Mode: networkBridge, Address: "172.18.0.2/16", Gateway: "172.18.0.1"}
+	tests := []struct {
+		name    string
+		host    string
+		network containerNetwork
+		dns     dnsConfig
+		want    string
+	}{
+		{
+			name:    "remote nameservers",
+			host:    "# generated\nnameserver 192.168.1.1\nnameserver 1.1.1.1\nsearch lan\noptions edns0\n",
+			network: bridge,
+			want:    "nameserver 192.168.1.1\nnameserver 1.1.1.1\nsearch lan\noptions edns0\n",
+		},
+		{
+			name:    "loopback nameservers dropped",
+			host:    "nameserver 127.0.0.53\nnameserver ::1\nnameserver 10.0.0.1\n",
+			network: bridge,
+			want:    "nameserver 10.0.0.1\n",
+		},
+		{
+			name:    "only loopback nameservers",
+			host:    "nameserver 127.0.0.53\noptions edns0 trust-ad\nsearch .\n",
+			network: bridge,
+			want:    "nameserver 8.8.8.8\nnameserver 8.8.4.4\noptions edns0 trust-ad\n",
+		},
+		{
+			name:    "no host resolv.conf",
+			network: bridge,
+			want:    "nameserver 8.8.8.8\nnameserver 8.8.4.4\n",
+		},
+		{
+			name:    "host network keeps loopback nameservers",
+			host:    "nameserver 127.0.0.53\nsearch lan\n",
+			network: containerNetwork{Mode: networkHost},
+			want:    "nameserver 127.0.0.53\nsearch lan\n",
+		},
+		{
+			name:    "no network",
+			host:    "nameserver 127.0.0.53\n",
+			network: containerNetwork{Mode: networkNone},
+			want:    "",
+		},
+		{
+			name:    "domain sets the search list",
+			host:    "nameserver 10.0.0.1\ndomain example.com\n",
+			network: bridge,
+			want:    "nameserver 10.0.0.1\nsearch example.com\n",
+		},
+		{
+			name:    "--dns and --dns-search",
+			host:    "nameserver 10.0.0.1\nsearch lan\n",
+			network: bridge,
+			dns:     dnsConfig{Servers: []string{"9.9.9.9"}, Search: []string{"a.example", "b.example"}},
+			want:    "nameserver 9.9.9.9\nsearch a.example b.example\n",
+		},
+		{
+			name:    "--dns-search . clears the search list",
+			host:    "nameserver 10.0.0.1\nsearch lan\n",
+			network: bridge,
+			dns:     dnsConfig{Search: []string{"."}},
+			want:    "nameserver 10.0.0.1\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useHostFile(t, &hostResolvConfPath, test.host)
+
+			resolvConf, err := resolvConfFile(test.network, test.dns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(resolvConf) != test.want {
+				t.Errorf("resolv.conf = %q, want %q", resolvConf, test.want)
+			}
+		})
+	}
+}
+
+func TestHostsFile(t *testing.T) {
+	const localhost = "127.0.0.1\tlocalhost\n" +
+		"::1\tlocalhost ip6-localhost ip6-loopback\n" +
+		"fe00::0\tip6-localnet\n" +
+		"ff00::0\tip6-mcastprefix\n" +
+		"ff02::1\tip6-allnodes\n" +
+		"ff02::2\tip6-allrouters\n"
+	tests := []struct {
+		name       string
+		host       string
+		network    containerNetwork
+		extraHosts []hostEntry
+		want       string
+	}{
+		{
+			name:    "bridge network",
+			network: containerNetwork{Mode: networkBridge, Address: "172.18.0.2/16", Gateway: "172.18.0.1"},
+			want:    localhost + "172.18.0.2\tbox\n",
+		},
+		{
+			name:    "no network",
+			network: containerNetwork{Mode: networkNone},
+			want:    localhost,
+		},
+		{
+			name:    "host network",
+			host:    "127.0.0.1\tlocalhost\n10.0.0.5\tworkstation\n",
+			network: containerNetwork{Mode: networkHost},
+			want:    "127.0.0.1\tlocalhost\n10.0.0.5\tworkstation\n",
+		},
+		{
+			name:    "--add-host",
+			network: containerNetwork{Mode: networkBridge, Address: "172.18.0.2/16", Gateway: "172.18.0.1"},
+			extraHosts: []hostEntry{
+				{Name: "db", Address: "10.0.0.7"},
+				{Name: "v6", Address: "fd00::7"},
+				{Name: "host.docker.internal", Address: hostGatewayName},
+			},
+			want: localhost + "10.0.0.7\tdb\nfd00::7\tv6\n172.18.0.1\thost.docker.internal\n172.18.0.2\tbox\n",
+		},
+		{
+			name:       "--add-host with the host network",
+			host:       "127.0.0.1\tlocalhost\n",
+			network:    containerNetwork{Mode: networkHost},
+			extraHosts: []hostEntry{{Name: "db", Address: "10.0.0.7"}},
+			want:       "127.0.0.1\tlocalhost\n10.0.0.7\tdb\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useHostFile(t, &hostHostsPath, test.host)
+
+			hosts, err := hostsFile("box", test.network, test.extraHosts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(hosts) != test.want {
+				t.Errorf("hosts = %q, want %q", hosts, test.want)
+			}
+		})
+	}
+}
+
+func TestParseHostEntry(t *testing.T) {
+	tests := []struct {
+		value string
+		want  hostEntry
+	}{
+		{"db:10.0.0.7", hostEntry{Name: "db", Address: "10.0.0.7"}},
+		{"db=10.0.0.7", hostEntry{Name: "db", Address: "10.0.0.7"}},
+		{"v6:fd00::7", hostEntry{Name: "v6", Address: "fd00::7"}},
+		{"v6=[fd00::7]", hostEntry{Name: "v6", Address: "fd00::7"}},
+		{"host.docker.internal:host-gateway", hostEntry{Name: "host.docker.internal", Address: hostGatewayName}},
+	}
+	for _, test := range tests {
+		entry, err := parseHostEntry(test.value)
+		if err != nil || entry != test.want {
+			t.Errorf("parseHostEntry(%q) = %+v, %v, want %+v", test.value, entry, err, test.want)
+		}
+	}
+
+	for _, value := range []string{"db", ":10.0.0.7", "db:", "db:gateway", "db:10.0.0.300"} {
+		if entry, err := parseHostEntry(value); err == nil {
+			t.Errorf("parseHostEntry(%q) = %+v, want an error", value, entry)
+		} else if !strings.Contains(err.Error(), value) {
+			t.Errorf("parseHostEntry(%q): err = %v, want it to name the entry", value, err)
+		}
+	}
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+)
+
+func runCmd(cmd *cliCommand, args []string) int {
+	var options runOptions
+	var detach bool
+	var entrypoint string
+	var memory, memorySwap string
+	var env, envFiles, publish, dnsServers, dnsSearch, extraHosts, uidMappings, gidMappings stringList
+
+	flags := cmd.flagSet()
+	flags.BoolVar(&detach, "d", false, "Run container in background and print container ID")
+	flags.BoolVar(&detach, "detach", false, "Run container in background and print container ID")
+	flags.BoolVar(&options.Remove, "rm", false, "Automatically remove the container when it exits")
+	flags.StringVar(&entrypoint, "entrypoint", "", "Overwrite the default `ENTRYPOINT` of the image")
+	flags.Var(&env, "e", "Set environment variable `KEY[=VALUE]`, passing KEY through from the host without a value")
+	flags.Var(&env, "env", "Set environment variable `KEY[=VALUE]`, passing KEY through from the host without a value")
+	flags.Var(&envFiles, "env-file", "Read environment variables from `FILE`")
+	flags.StringVar(&options.WorkingDir, "w", "", "Working directory inside the container")
+	flags.StringVar(&options.WorkingDir, "workdir", "", "Working directory inside the container")
+	flags.StringVar(&options.User, "u", "", "Username or UID (format: `USER[:GROUP]`)")
+	flags.StringVar(&options.User, "user", "", "Username or UID (format: `USER[:GROUP]`)")
+	flags.StringVar(&options.Hostname, "h", "", "Container host name")
+	flags.StringVar(&options.Hostname, "hostname", "", "Container host name")
+	flags.StringVar(&memory, "m", "", "Memory limit, such as 512m or 1g")
+	flags.StringVar(&memory, "memory", "", "Memory limit, such as 512m or 1g")
+	flags.StringVar(&memorySwap, "memory-swap", "", "Limit of memory plus swap, -1 for unlimited swap")
+	flags.Float64Var(&options.Resources.Cpus, "cpus", 0, "Number of CPUs")
+	flags.Int64Var(&options.Resources.CpuShares, "cpu-shares", 0, "CPU shares (relative weight)")
+	flags.Int64Var(&options.Resources.PidsLimit, "pids-limit", 0, "Container pids limit, -1 for unlimited")
+	flags.Int64Var(&options.Resources.BlkioWeight, "blkio-weight", 0, "Block IO (relative weight), between 10 and 1000")
+	flags.StringVar(&options.Network, "network", "", "Connect the container to a network: `bridge`, host or none")
+	flags.StringVar(&options.Network, "net", "", "Connect the container to a network: `bridge`, host or none")
+	flags.Var(&publish, "p", "Publish a container's port to the host: `[HOST_IP:]HOST_PORT:CONTAINER_PORT[/PROTOCOL]`")
+	flags.Var(&publish, "publish", "Publish a container's port to the host: `[HOST_IP:]HOST_PORT:CONTAINER_PORT[/PROTOCOL]`")
+	flags.Var(&dnsServers, "dns", "Set custom DNS servers")
+	flags.Var(&dnsSearch, "dns-search", "Set custom DNS search domains")
+	flags.Var(&extraHosts, "add-host", "Add a custom host-to-IP mapping (`HOST:IP`)")
+	flags.Var(&uidMappings, "uidmap", "Run in a user namespace with the UID mapping `CONTAINER_ID:HOST_ID:SIZE`")
+	flags.Var(&gidMappings, "gidmap", "Run in a user namespace with the GID mapping `CONTAINER_ID:HOST_ID:SIZE`")
+	if code, ok := cmd.parseFlags(flags, args, 1, -1); !ok {
+		return code
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "entrypoint" {
+			options.Entrypoint = &entrypoint
+		}
+	})
+
+	// Variables given with -e take precedence over those from env files.
+	for _, envFile := range envFiles {
+		variables, err := readEnvFile(envFile)
+		if err != nil {
+			printError(cmd, err)
+			return 2
+		}
+		options.Env = append(options.Env, variables...)
+	}
+	for _, value := range env {
+		variable, ok, err := parseEnvVariable(value)
+		if err != nil {
+			printError(cmd, err)
+			return 2
+		}
+		if ok {
+			options.Env = append(options.Env, variable)
+		}
+	}
+
+	if options.WorkingDir != "" && !path.IsAbs(options.WorkingDir) {
+		printError(cmd, fmt.Errorf("the working directory %q is invalid, it needs to be an absolute path", options.WorkingDir))
+		return 2
+	}
+
+	var err error
+	if memory != "" {
+		options.Resources.Memory, err = parseByteSize(memory)
+	}
+	if err == nil && memorySwap == "-1" {
+		options.Resources.MemorySwap = -1
+	} else if err == nil && memorySwap != "" {
+		options.Resources.MemorySwap, err = parseByteSize(memorySwap)
+	}
+	if err == nil {
+		err = options.Resources.validate(runtime.NumCPU())
+	}
+	if err != nil {
+		printError(cmd, err)
+		return 2
+	}
+
+	options.Network, err = parseNetworkMode(options.Network)
+	if err != nil {
+		printError(cmd, err)
+		return 2
+	}
+
+	for _, value := range publish {
+		mapping, err := parsePortMapping(value)
+		if err != nil {
+			printError(cmd, err)
+			return 2
+		}
+		options.Ports = append(options.Ports, mapping)
+	}
+	switch {
+	case len(options.Ports) > 0 && options.Network == networkHost:
+		fmt.Fprintln(os.Stderr, "WARNING: Published ports are discarded when using host network mode")
+		options.Ports = nil
+	case len(options.Ports) > 0 && options.Network == networkNone:
+		printError(cmd, fmt.Errorf("publishing ports requires the bridge network"))
+		return 2
+	}
+
+	for _, server := range dnsServers {
+		if net.ParseIP(server) == nil {
+			printError(cmd, fmt.Errorf("invalid DNS server %q: not an IP address", server))
+			return 2
+		}
+	}
+	options.DNS.Servers = dnsServers
+	options.DNS.Search = dnsSearch
+	for _, value := range extraHosts {
+		entry, err := parseHostEntry(value)
+		if err != nil {
+			printError(cmd, err)
+			return 2
+		}
+		options.DNS.ExtraHosts = append(options.DNS.ExtraHosts, entry)
+	}
+
+	options.Ids, err = newIdMap(uidMappings, gidMappings)
+	if err != nil {
+		printError(cmd, err)
+		return 2
+	}
+
+	image := flags.Arg(0)
+	commandArgs := flags.Args()[1:]
+
+	imageId, err := ensureImage(image, newPullProgress(os.Stderr))
+	if err != nil {
+		printError(cmd, err)
+		return 1
+	}
+
+	state, err := newContainerState(image, imageId)
+	if err != nil {
+		printError(cmd, err)
+		return 1
+	}
+
+	if detach {
+		exitCode, err := runDetached(state, commandArgs, options)
+		if err != nil {
+			printError(cmd, err)
+			return exitCode
+		}
+		fmt.Println(state.Id)
+		return 0
+	}
+
+	exitCode, err := runCommand(state, commandArgs, options, nil)
+	if err != nil {
+		printError(cmd, err)
+	}
+
+	return exitCode
+}
+
+func pullCmd(cmd *cliCommand, args []string) int {
+	var concurrency int
+
+	flags := cmd.flagSet()
+	flags.IntVar(&concurrency, "max-concurrent-downloads", defaultMaxConcurrentDownloads, "Maximum number of layers to download at once")
+	if code, ok := cmd.parseFlags(flags, args, 1, 1); !ok {
+		return code
+	}
+
+	if concurrency < 1 {
+		printError(cmd, fmt.Errorf("--max-concurrent-downloads must be at least 1"))
+		return 2
+	}
+
+	_, err := pullImage(flags.Arg(0), newPullProgress(os.Stdout), concurrency)
+	if err != nil {
+		printError(cmd, err)
+		return 1
+	}
+
+	return 0
+}
+
+func imagesCmd(cmd *cliCommand, args []string) int {
+	flags := cmd.flagSet()
+	if code, ok := cmd.parseFlags(flags, args, 0, 0); !ok {
+		return code
+	}
+
+	images, err := listImages()
+	if err != nil {
+		printError(cmd, err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tSIZE")
+	for _, image := range images {
+		created := "N/A"
+		if !image.Created.IsZero() {
+			created = image.Created.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", image.Repository, image.Tag, shortId(image.Id), created, humanSize(image.Size))
+	}
+	_ = w.Flush()
+
+	return 0
+}
+
+func rmiCmd(cmd *cliCommand, args []string) int {
+	var force bool
+
+	flags := cmd.flagSet()
+	flags.BoolVar(&force, "f", false, "Force removal of images used by containers")
+	flags.BoolVar(&force, "force", false, "Force removal of images used by containers")
+	if code, ok := cmd.parseFlags(flags, args, 1, -1); !ok {
+		return code
+	}
+
+	exitCode := 0
+	for _, image := range flags.Args() {
+		lines, err := removeImage(image, force)
+		if err != nil {
+			printError(cmd, err)
+			exitCode = 1
+			continue
+		}
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+	}
+
+	return exitCode
+}
+
+func psCmd(cmd *cliCommand, args []string) int {
+	var all bool
+	var format string
+
+	flags := cmd.flagSet()
+	flags.BoolVar(&all, "a", false, "Show all containers (default shows just running)")
+	flags.BoolVar(&all, "all", false, "Show all containers (default shows just running)")
+	flags.StringVar(&format, "format", defaultPsFormat, "Format output using a Go `template`, \"table TEMPLATE\" or \"json\"")
+	if code, ok := cmd.parseFlags(flags, args, 0, 0); !ok {
+		return code
+	}
+
+	// Tabs and newlines are hard to type on a command line.
+	format = strings.NewReplacer(`\t`, "\t", `\n`, "\n").Replace(format)
+	table := strings.HasPrefix(format, "table ")
+	tmpl, err := template.New("ps").Parse(strings.TrimPrefix(format, "table "))
+	if err != nil {
+		printError(cmd, fmt.Errorf("invalid format: %w", err))
+		return 2
+	}
+
+	containers, err := listContainers()
+	if err != nil {
+		printError(cmd, err)
+		return 1
+	}
+
+	var rows []psRow
+	for _, container := range containers {
+		if all || container.Status == containerRunning {
+			rows = append(rows, newPsRow(container))
+		}
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, row := range rows {
+			_ = encoder.Encode(row)
+		}
+		return 0
+	}
+
+	var w io.Writer = os.Stdout
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	if table {
+		w = tw
+		rows = append([]psRow{psHeader}, rows...)
+	}
+	for _, row := range rows {
+		err = tmpl.Execute(w, row)
+		if err != nil {
+			printError(cmd, err)
+			return 1
+		}
+		fmt.Fprintln(w)
+	}
+	_ = tw.Flush()
+
+	return 0
+}
+
+// psRow is a container as ps shows it, and what --format templates are
+// executed with. Table headers are the template executed with psHeader.
+type psRow struct {
+	ID         string
+	Image      string
+	Command    string
+	CreatedAt  string
+	RunningFor string
+	Ports      string
+	State      string
+	Status     string
+}
+
+var psHeader = psRow{
+	ID:         "CONTAINER ID",
+	Image:      "IMAGE",
+	Command:    "COMMAND",
+	CreatedAt:  "CREATED AT",
+	RunningFor: "CREATED",
+	Ports:      "PORTS",
+	State:      "STATE",
+	Status:     "STATUS",
+}
+
+const defaultPsFormat = "table {{.ID}}\t{{.Image}}\t{{.Command}}\t{{.RunningFor}}\t{{.Status}}\t{{.Ports}}"
+
+// psCommandWidth is how much of a container's command ps shows.
+const psCommandWidth = 20
+
+func newPsRow(container containerState) psRow {
+	command := []rune(strings.Join(container.Command, " "))
+	if len(command) > psCommandWidth {
+		command = append(command[:psCommandWidth-1], '…')
+	}
+
+	row := psRow{
+		ID:         shortId(container.Id),
+		Image:      container.Image,
+		Command:    `"` + string(command) + `"`,
+		CreatedAt:  container.Created.Local().Format("2006-01-02 15:04:05 -0700 MST"),
+		RunningFor: humanDuration(time.Since(container.Created)) + " ago",
+		State:      container.Status,
+	}
+	switch container.Status {
+	case containerCreated:
+		row.Status = "Created"
+	case containerRunning:
+		row.Status = "Up " + humanDuration(time.Since(container.Started))
+		row.Ports = describePorts(container.Ports)
+	default:
+		row.Status = fmt.Sprintf("Exited (%d)", container.ExitCode)
+		if !container.Finished.IsZero() {
+			row.Status += " " + humanDuration(time.Since(container.Finished)) + " ago"
+		}
+	}
+	return row
+}
+
+func stopCmd(cmd *cliCommand, args []string) int {
+	var timeout int
+
+	flags := cmd.flagSet()
+	flags.IntVar(&timeout, "t", 10, "Seconds to wait before killing the container")
+	flags.IntVar(&timeout, "time", 10, "Seconds to wait before killing the container")
+	if code, ok := cmd.parseFlags(flags, args, 1, -1); !ok {
+		return code
+	}
+
+	if timeout < 0 {
+		printError(cmd, fmt.Errorf("--time must not be negative"))
+		return 2
+	}
+
+	exitCode := 0
+	for _, id := range flags.Args() {
+		container, err := findContainer(id)
+		if err == nil {
+			err = stopContainer(container, time.Duration(timeout)*time.Second)
+		}
+		if err != nil {
+			printError(cmd, err)
+			exitCode = 1
+			continue
+		}
+		fmt.Println(id)
+	}
+
+	return exitCode
+}
+
+func killCmd(cmd *cliCommand, args []string) int {
+	var signal string
+
+	flags := cmd.flagSet()
+	flags.StringVar(&signal, "s", "KILL", "Signal to send to the container")
+	flags.StringVar(&signal, "signal", "KILL", "Signal to send to the container")
+	if code, ok := cmd.parseFlags(flags, args, 1, -1); !ok {
+		return code
+	}
+
+	sig, err := parseSignal(signal)
+	if err != nil {
+		printError(cmd, err)
+		return 2
+	}
+
+	exitCode := 0
+	for _, id := range flags.Args() {
+		container, err := findContainer(id)
+		if err == nil {
+			err = signalContainer(container, sig)
+		}
+		if err != nil {
+			printError(cmd, err)
+			exitCode = 1
+			continue
+		}
+		fmt.Println(id)
+	}
+
+	return exitCode
+}
+
+func rmCmd(cmd *cliCommand, args []string) int {
+	var force bool
+
+	flags := cmd.flagSet()
+	flags.BoolVar(&force, "f", false, "Force the removal of a running container")
+	flags.BoolVar(&force, "force", false, "Force the removal of a running container")
+	if code, ok := cmd.parseFlags(flags, args, 1, -1); !ok {
+		return code
+	}
+
+	exitCode := 0
+	for _, id := range flags.Args() {
+		container, err := findContainer(id)
+		if err == nil {
+			err = removeContainer(container, force)
+		}
+		if err != nil {
+			printError(cmd, err)
+			exitCode = 1
+			continue
+		}
+		fmt.Println(id)
+	}
+
+	return exitCode
+}
+
+func waitCmd(cmd *cliCommand, args []string) int {
+	flags := cmd.flagSet()
+	if code, ok := cmd.parseFlags(flags, args, 1, -1); !ok {
+		return code
+	}
+
+	exitCode := 0
+	for _, id := range flags.Args() {
+		container, err := findContainer(id)
+		if err == nil {
+			container, err = waitForContainer(container.Id, time.Time{})
+		}
+		// Containers run with --rm are gone as soon as they exit.
+		if os.IsNotExist(err) {
+			err = fmt.Errorf("container %s was removed before its exit code could be read", id)
+		}
+		if err != nil {
+			printError(cmd, err)
+			exitCode = 1
+			continue
+		}
+		fmt.Println(container.ExitCode)
+	}
+
+	return exitCode
+}
+
+func execCmd(cmd *cliCommand, args []string) int {
+	flags := cmd.flagSet()
+	if code, ok := cmd.parseFlags(flags, args, 2, -1); !ok {
+		return code
+	}
+
+	container, err := findContainer(flags.Arg(0))
+	if err != nil {
+		printError(cmd, err)
+		return 1
+	}
+
+	exitCode, err := execCommand(container, flags.Args()[1:])
+	if err != nil {
+		printError(cmd, err)
+	}
+
+	return exitCode
+}
+
+func inspectCmd(cmd *cliCommand, args []string) int {
+	flags := cmd.flagSet()
+	if code, ok := cmd.parseFlags(flags, args, 1, 1); !ok {
+		return code
+	}
+
+	details, err := inspectImage(flags.Arg(0))
+	if err != nil {
+		printError(cmd, err)
+		return 1
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(details); err != nil {
+		printError(cmd, err)
+		return 1
+	}
+
+	return 0
+}
+
+func versionCmd(cmd *cliCommand, args []string) int {
+	flags := cmd.flagSet()
+	if code, ok := cmd.parseFlags(flags, args, 0, 0); !ok {
+		return code
+	}
+
+	fmt.Printf("mydocker version %s (%s %s/%s)\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return 0
+}
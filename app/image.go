@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+type imageSummary struct {
+	Id         string
+	Repository string
+	Tag        string
+	Created    time.Time
+	Size       int64
+}
+
+type imageDetails struct {
+	Id           string      `json:"Id"`
+	RepoTags     []string    `json:"RepoTags"`
+	RepoDigests  []string    `json:"RepoDigests"`
+	Created      time.Time   `json:"Created"`
+	Os           string      `json:"Os"`
+	Architecture string      `json:"Architecture"`
+	Size         int64       `json:"Size"`
+	RootFS       ImageRootFS `json:"RootFS"`
+}
+
+// listImages returns one summary per tag of every local image, and a single
+// untagged summary for images without tags.
+func listImages() ([]imageSummary, error) {
+	records, err := listImageRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	var images []imageSummary
+	for _, record := range records {
+		summary := imageSummary{
+			Id:         record.Id,
+			Repository: "<none>",
+			Tag:        "<none>",
+			Created:    record.Created,
+			Size:       imageSize(record),
+		}
+
+		if len(record.RepoTags) == 0 {
+			images = append(images, summary)
+			continue
+		}
+		for _, repoTag := range record.RepoTags {
+			summary.Repository, summary.Tag = familiarRepoTag(repoTag)
+			images = append(images, summary)
+		}
+	}
+
+	return images, nil
+}
+
+// imageSize returns the uncompressed size of all layers of the image.
+func imageSize(record imageRecord) int64 {
+	var size int64
+	for _, diffId := range uniqueStrings(record.Layers) {
+		layer, err := readLayerRecord(diffId)
+		if err == nil {
+			size += layer.Size
+		}
+	}
+	return size
+}
+
+func familiarRepoTag(repoTag string) (string, string) {
+	ref, err := parseReference(repoTag)
+	if err != nil {
+		return repoTag, "<none>"
+	}
+	return ref.FamiliarName(), ref.Tag
+}
+
+// findImageByReference returns the local image a tag or digest reference
+// points to.
+func findImageByReference(ref imageReference) (imageRecord, error) {
+	records, err := listImageRecords()
+	if err != nil {
+		return imageRecord{}, err
+	}
+
+	for _, record := range records {
+		if ref.Digest != "" && containsString(record.RepoDigests, ref.Name()+"@"+ref.Digest) {
+			return record, nil
+		}
+		if ref.Digest == "" && containsString(record.RepoTags, ref.Name()+":"+ref.Tag) {
+			return record, nil
+		}
+	}
+
+	return imageRecord{}, fmt.Errorf("no such image: %s: %w", ref, os.ErrNotExist)
+}
+
+// findLocalImage returns the local image that name refers to, either as a
+// reference or as a prefix of its ID (with or without the "sha256:" prefix).
+func findLocalImage(name string) (imageRecord, error) {
+	if ref, err := parseReference(name); err == nil {
+		if record, err := findImageByReference(ref); err == nil {
+			return record, nil
+		}
+	}
+
+	records, err := listImageRecords()
+	if err != nil {
+		return imageRecord{}, err
+	}
+
+	var matches []imageRecord
+	for _, record := range records {
+		if strings.HasPrefix(record.Id, name) || strings.HasPrefix(trimDigestAlgorithm(record.Id), name) {
+			matches = append(matches, record)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return imageRecord{}, fmt.Errorf("no such image: %s", name)
+	case 1:
+		return matches[0], nil
+	default:
+		return imageRecord{}, fmt.Errorf("image id prefix %s is ambiguous", name)
+	}
+}
+
+// removeImage removes the tag name refers to, deleting the image once no tag
+// is left. Images referred to by ID or digest are deleted with all their tags.
+// Images that containers use are only deleted when force is set. It returns
+// the lines to report, in the style of "docker rmi".
+func removeImage(name string, force bool) ([]string, error) {
+	record, err := findLocalImage(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if ref, err := parseReference(name); err == nil && ref.Digest == "" {
+		repoTag := ref.Name() + ":" + ref.Tag
+		if containsString(record.RepoTags, repoTag) {
+			if len(record.RepoTags) == 1 && !force {
+				if err := checkImageUnused(record.Id); err != nil {
+					return nil, err
+				}
+			}
+			deleted, err := untagImage(record.Id, repoTag)
+			if err != nil {
+				return nil, err
+			}
+
+			repository, tag := familiarRepoTag(repoTag)
+			lines := []string{fmt.Sprintf("Untagged: %s:%s", repository, tag)}
+			if deleted {
+				lines = append(lines, fmt.Sprintf("Deleted: %s", record.Id))
+			}
+			return lines, nil
+		}
+	}
+
+	if !force {
+		if err := checkImageUnused(record.Id); err != nil {
+			return nil, err
+		}
+	}
+
+	var lines []string
+	for _, repoTag := range record.RepoTags {
+		repository, tag := familiarRepoTag(repoTag)
+		lines = append(lines, fmt.Sprintf("Untagged: %s:%s", repository, tag))
+	}
+
+	err = deleteImage(record.Id)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return append(lines, fmt.Sprintf("Deleted: %s", record.Id)), nil
+}
+
+// checkImageUnused returns an error if a container uses the image, whose
+// layers are then the lower directories of the container's rootfs.
+func checkImageUnused(imageId string) error {
+	containers, err := listContainers()
+	if err != nil {
+		return err
+	}
+
+	for _, container := range containers {
+		if container.ImageId == imageId {
+			return fmt.Errorf("unable to remove image %s: image is being used by container %s", shortId(imageId), shortId(container.Id))
+		}
+	}
+	return nil
+}
+
+func inspectImage(name string) (imageDetails, error) {
+	record, err := findLocalImage(name)
+	if err != nil {
+		return imageDetails{}, err
+	}
+
+	details := imageDetails{
+		Id:           record.Id,
+		RepoTags:     record.RepoTags,
+		RepoDigests:  record.RepoDigests,
+		Created:      record.Created,
+		Os:           record.Os,
+		Architecture: record.Architecture,
+		Size:         imageSize(record),
+		RootFS:       ImageRootFS{Type: "layers", DiffIds: record.Layers},
+	}
+	if details.RepoTags == nil {
+		details.RepoTags = []string{}
+	}
+	if details.RepoDigests == nil {
+		details.RepoDigests = []string{}
+	}
+
+	return details, nil
+}
+
+func trimDigestAlgorithm(id string) string {
+	if i := strings.Index(id, ":"); i >= 0 {
+		return id[i+1:]
+	}
+	return id
+}
+
+func shortId(id string) string {
+	id = trimDigestAlgorithm(id)
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// containerInitArg is the argv[0] under which mydocker re-executes itself as
+// the first process of a container. That process runs in the new namespaces,
+// sets up the root filesystem and then execs the container command.
+const containerInitArg = "mydocker-init"
+
+// The init process receives its containerSpec on the first extra file and
+// reports setup failures on the second, which it closes by exec'ing the
+// command. An empty error pipe thus means the command is running.
+const (
+	initSpecFd  = 3
+	initErrorFd = 4
+)
+
+// A command exec'd in a running container is started the same way, by
+// mydocker running in the container's namespaces, which nsenter joins. The
+// mount namespace, which would hide the mydocker binary, is left to mydocker
+// to join once running. nsenter runs it from a descriptor passed after the
+// spec and error pipes, followed by one of the mount namespace, and it knows
+// what it is there for by that path.
+const (
+	execBinaryFd      = 5
+	execMountNsFd     = 6
+	containerExecPath = "/proc/self/fd/5"
+)
+
+// containerSpec describes the process to start in a container.
+type containerSpec struct {
+	RootFs     string           `json:"rootFs"`
+	Args       []string         `json:"args"`
+	Env        []string         `json:"env"`
+	WorkingDir string           `json:"workingDir"`
+	User       string           `json:"user"`
+	Hostname   string           `json:"hostname"`
+	Network    containerNetwork `json:"network"`
+	// Mounts are bind mounted into the rootfs before anything else.
+	Mounts []containerBindMount `json:"mounts"`
+}
+
+// containerInitError is what the init process sends back when it cannot
+// start the command, with the exit code to report.
+type containerInitError struct {
+	Message  string `json:"message"`
+	ExitCode int    `json:"exitCode"`
+}
+
+func (e *containerInitError) Error() string {
+	return e.Message
+}
+
+// containerInit is the entry point of the init process. It only returns when
+// the command could not be started.
+func containerInit() int {
+	return startContainerProcess(startContainer)
+}
+
+// containerExec is the entry point of a command exec'd in a running
+// container, already in the container's namespaces but its mount namespace.
+// It only returns when the command could not be started.
+func containerExec() int {
+	syscall.CloseOnExec(execBinaryFd)
+	syscall.CloseOnExec(execMountNsFd)
+	return startContainerProcess(func(spec containerSpec) error {
+		err := enterMountNamespace(execMountNsFd)
+		if err != nil {
+			return err
+		}
+		return startCommand(spec)
+	})
+}
+
+// enterMountNamespace moves the current thread, to which the calling
+// goroutine stays locked, into the mount namespace open as fd. The kernel
+// only allows that to threads that do not share their filesystem
+// attributes, which those of a Go program do.
+func enterMountNamespace(fd int) error {
+	runtime.LockOSThread()
+	err := syscall.Unshare(syscall.CLONE_FS)
+	if err == nil {
+		err = setns(fd, syscall.CLONE_NEWNS)
+	}
+	if err != nil {
+		return fmt.Errorf("error entering mount namespace: %w", err)
+	}
+	return nil
+}
+
+func setns(fd int, nsType int) error {
+	_, _, errno := syscall.Syscall(sysSetns, uintptr(fd), uintptr(nsType), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// startContainerProcess reads the spec of a container process and starts it,
+// reporting failures on the error pipe.
+func startContainerProcess(start func(spec containerSpec) error) int {
+	errorPipe := os.NewFile(initErrorFd, "init-error")
+	syscall.CloseOnExec(initErrorFd)
+
+	var spec containerSpec
+	specPipe := os.NewFile(initSpecFd, "init-spec")
+	err := json.NewDecoder(specPipe).Decode(&spec)
+	_ = specPipe.Close()
+	if err != nil {
+		err = fmt.Errorf("error reading container spec: %w", err)
+	} else {
+		err = start(spec)
+	}
+
+	initErr := &containerInitError{Message: err.Error(), ExitCode: 125}
+	switch {
+	case errors.Is(err, os.ErrNotExist) || errors.Is(err, exec.ErrNotFound):
+		initErr.ExitCode = 127
+	case errors.Is(err, os.ErrPermission):
+		initErr.ExitCode = 126
+	}
+
+	_ = json.NewEncoder(errorPipe).Encode(initErr)
+	return initErr.ExitCode
+}
+
+// startContainer sets up the namespaces of a new container and starts its
+// command.
+func startContainer(spec containerSpec) error {
+	err := syscall.Sethostname([]byte(spec.Hostname))
+	if err != nil {
+		return fmt.Errorf("error setting hostname: %w", err)
+	}
+
+	err = configureNetwork(spec.Network)
+	if err != nil {
+		return fmt.Errorf("error configuring network: %w", err)
+	}
+
+	err = setupRootFs(spec.RootFs, spec.Mounts)
+	if err != nil {
+		return err
+	}
+
+	return startCommand(spec)
+}
+
+// startCommand execs the command of spec, from within the container, as the
+// container user and with the container's environment.
+func startCommand(spec containerSpec) error {
+	if len(spec.Args) == 0 {
+		return fmt.Errorf("no command specified")
+	}
+
+	// The command is looked up in the container's PATH.
+	os.Clearenv()
+	for _, variable := range spec.Env {
+		if key, value, ok := strings.Cut(variable, "="); ok {
+			_ = os.Setenv(key, value)
+		}
+	}
+
+	user, err := lookupContainerUser(spec.User)
+	if err != nil {
+		return err
+	}
+	if _, ok := os.LookupEnv("HOME"); !ok {
+		_ = os.Setenv("HOME", user.Home)
+	}
+
+	// The working directory is created as root when missing, but entered as
+	// the container user, who must have access to it.
+	err = os.MkdirAll(spec.WorkingDir, 0755)
+	if err != nil {
+		return fmt.Errorf("error creating working directory: %w", err)
+	}
+
+	err = setCredentials(user)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chdir(spec.WorkingDir)
+	if err != nil {
+		return fmt.Errorf("error changing to working directory: %w", err)
+	}
+
+	commandPath, err := exec.LookPath(spec.Args[0])
+	if err != nil {
+		return fmt.Errorf("error starting %s: %w", spec.Args[0], err)
+	}
+
+	err = syscall.Exec(commandPath, spec.Args, os.Environ())
+	return fmt.Errorf("error starting %s: %w", spec.Args[0], err)
+}
+
+// setCredentials switches to the IDs of user, dropping the capabilities of
+// root unless user is root.
+func setCredentials(user containerUser) error {
+	err := syscall.Setgroups(user.Groups)
+	if err == nil {
+		err = syscall.Setgid(user.Gid)
+	}
+	if err == nil {
+		err = syscall.Setuid(user.Uid)
+	}
+	if err != nil {
+		return fmt.Errorf("error setting user %d:%d: %w", user.Uid, user.Gid, err)
+	}
+	return nil
+}
+
+type containerMount struct {
+	source string
+	target string
+	fsType string
+	flags  uintptr
+	data   string
+}
+
+var containerMounts = []containerMount{
+	{source: "proc", target: "/proc", fsType: "proc", flags: syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV},
+	{source: "sysfs", target: "/sys", fsType: "sysfs", flags: syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV | syscall.MS_RDONLY},
+	{source: "cgroup", target: "/sys/fs/cgroup", fsType: "cgroup2", flags: syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV | syscall.MS_RDONLY},
+	{source: "tmpfs", target: "/dev", fsType: "tmpfs", flags: syscall.MS_NOSUID | syscall.MS_STRICTATIME, data: "mode=755,size=65536k"},
+	{source: "devpts", target: "/dev/pts", fsType: "devpts", flags: syscall.MS_NOSUID | syscall.MS_NOEXEC, data: "newinstance,ptmxmode=0666,mode=0620"},
+	{source: "shm", target: "/dev/shm", fsType: "tmpfs", flags: syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV, data: "mode=1777,size=65536k"},
+}
+
+type containerDevice struct {
+	name  string
+	major int64
+	minor int64
+}
+
+var containerDevices = []containerDevice{
+	{name: "null", major: 1, minor: 3},
+	{name: "zero", major: 1, minor: 5},
+	{name: "full", major: 1, minor: 7},
+	{name: "random", major: 1, minor: 8},
+	{name: "urandom", major: 1, minor: 9},
+	{name: "tty", major: 5, minor: 0},
+}
+
+var containerDevLinks = map[string]string{
+	"ptmx":   "pts/ptmx",
+	"fd":     "/proc/self/fd",
+	"stdin":  "/proc/self/fd/0",
+	"stdout": "/proc/self/fd/1",
+	"stderr": "/proc/self/fd/2",
+}
+
+// setupRootFs makes rootFs the root of the container's mount namespace, with
+// /proc, a read-only /sys with the container's cgroup at /sys/fs/cgroup, and
+// a minimal /dev mounted in it.
+func setupRootFs(rootFs string, mounts []containerBindMount) error {
+	// Mounts made from here on must neither propagate to the host nor
+	// receive host mounts.
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("error making mounts private: %w", err)
+	}
+
+	// pivot_root requires the new root to be a mount point.
+	err = syscall.Mount(rootFs, rootFs, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return fmt.Errorf("error bind mounting rootfs: %w", err)
+	}
+
+	for _, m := range mounts {
+		var targetPath string
+		targetPath, err = fileMountTargetPath(rootFs, m.Target)
+		if err == nil {
+			err = bindMount(m.Source, targetPath, false)
+		}
+		if err != nil {
+			return fmt.Errorf("error mounting %s: %w", m.Target, err)
+		}
+	}
+
+	for _, m := range containerMounts {
+		err = mountInRootFs(rootFs, m)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, device := range containerDevices {
+		err = createDevice(rootFs, device)
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, target := range containerDevLinks {
+		err = os.Symlink(target, path.Join(rootFs, "dev", name))
+		if err != nil {
+			return fmt.Errorf("error creating /dev/%s: %w", name, err)
+		}
+	}
+
+	return pivotRoot(rootFs)
+}
+
+// mountTargetPath returns the path of target inside rootFs, creating it as a
+// directory when missing. The image must not be able to redirect a mount to
+// the host with a symlink.
+func mountTargetPath(rootFs, target string) (string, error) {
+	targetPath, err := resolveEntryPath(rootFs, target[1:])
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Lstat(targetPath)
+	if os.IsNotExist(err) {
+		return targetPath, os.Mkdir(targetPath, 0755)
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return "", fmt.Errorf("mount target %s is a symlink", target)
+	}
+
+	return targetPath, nil
+}
+
+// fileMountTargetPath is mountTargetPath for mounting files. A symlink at
+// target, such as the common /etc/resolv.conf pointing to a resolver's
+// runtime directory, is replaced by a file, in the container's copy of the
+// image only.
+func fileMountTargetPath(rootFs, target string) (string, error) {
+	targetPath, err := resolveEntryPath(rootFs, target[1:])
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Lstat(targetPath)
+	if err == nil && info.IsDir() {
+		return "", fmt.Errorf("mount target %s is a directory", target)
+	}
+	if err == nil && info.Mode()&os.ModeSymlink != 0 {
+		err = os.Remove(targetPath)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	file, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		return "", err
+	}
+	return targetPath, file.Close()
+}
+
+func mountInRootFs(rootFs string, m containerMount) error {
+	targetPath, err := mountTargetPath(rootFs, m.target)
+	if err != nil {
+		return fmt.Errorf("error mounting %s: %w", m.target, err)
+	}
+
+	err = syscall.Mount(m.source, targetPath, m.fsType, m.flags, m.data)
+	if err != nil && m.fsType == "sysfs" {
+		// Mounting sysfs is refused when the network namespace is not owned
+		// by the container; the host's, read-only, will do.
+		err = bindMount("/sys", targetPath, true)
+	}
+	if err != nil {
+		return fmt.Errorf("error mounting %s: %w", m.target, err)
+	}
+
+	return nil
+}
+
+// createDevice creates a device node in /dev of rootFs. Where creating
+// device nodes is not allowed, as in a user namespace, the host's node is
+// bind mounted instead.
+func createDevice(rootFs string, device containerDevice) error {
+	devicePath := path.Join(rootFs, "dev", device.name)
+
+	err := syscall.Mknod(devicePath, syscall.S_IFCHR|0666, makeDev(device.major, device.minor))
+	if err == nil {
+		err = os.Chmod(devicePath, 0666)
+	} else if errors.Is(err, syscall.EPERM) {
+		var file *os.File
+		file, err = os.Create(devicePath)
+		if err == nil {
+			_ = file.Close()
+			err = bindMount(path.Join("/dev", device.name), devicePath, false)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error creating /dev/%s: %w", device.name, err)
+	}
+
+	return nil
+}
+
+func bindMount(source, target string, readOnly bool) error {
+	err := syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil || !readOnly {
+		return err
+	}
+	return syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_REC, "")
+}
+
+// pivotRoot makes rootFs the root directory and detaches the old root, so
+// that nothing of the host filesystem stays reachable. Stacking the old root
+// on top of the new one avoids needing a directory for it in the rootfs.
+func pivotRoot(rootFs string) error {
+	err := syscall.Chdir(rootFs)
+	if err != nil {
+		return fmt.Errorf("error entering rootfs: %w", err)
+	}
+
+	err = syscall.PivotRoot(".", ".")
+	if err != nil {
+		return fmt.Errorf("error pivoting to rootfs: %w", err)
+	}
+
+	err = syscall.Unmount(".", syscall.MNT_DETACH)
+	if err != nil {
+		return fmt.Errorf("error detaching old root: %w", err)
+	}
+
+	return syscall.Chdir("/")
+}
@@ -0,0 +1,11 @@
+//go:build race
+
+package zstd
+
+// The tests are those of the standard library's internal/zstd, changed only
+// to read Isaac.Newton-Opticks.txt from this package's testdata and to do
+// without internal/race and internal/testenv, which cannot be imported from
+// outside the standard library. raceEnabled stands in for race.Enabled;
+// testenv.SkipIfOptimizationOff is dropped, as only the Go builders set the
+// noopt tag it checks for.
+const raceEnabled = true
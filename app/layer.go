@@ -0,0 +1,432 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/codecrafters-io/docker-starter-go/app/internal/zstd"
+)
+
+// pullLayer downloads layer and extracts it into the layer store in a single
+// pass: the response body is verified against the layer digest, decompressed,
+// hashed for the diff-ID and unpacked as it arrives, without writing the
+// uncompressed tar to disk. The compressed blob is kept in the ingest
+// directory only until the layer is extracted, so that a pull interrupted
+// along with mydocker can resume its download. The layer is assembled in a
+// temporary directory and only renamed into place once both digests have been
+// checked. It returns the diff-ID of the layer.
+func pullLayer(ctx context.Context, layer layerDescriptor, tokens *authTokenSource, progress *pullProgress) (string, error) {
+	fileType, compressor := getLayerFileInfo(layer.MediaType)
+	if fileType != "tar" {
+		return "", fmt.Errorf("unsupported layer type %s", layer.MediaType)
+	}
+
+	progressId := shortId(layer.Digest)
+	progress.update(progressId, "Pulling fs layer")
+
+	for attempt := 1; ; attempt++ {
+		body, err := openBlobStream(ctx, layer, tokens, progress)
+		if err != nil {
+			return "", err
+		}
+
+		resumed := body.replay > 0
+		diffId, err := extractLayer(layer, compressor, body, progress)
+		if err == nil || errors.Is(err, errContentVerification) {
+			body.discard()
+		} else {
+			_ = body.Close()
+		}
+		// A partial download left by an earlier pull is fetched once more
+		// from the start if the layer fails verification.
+		if errors.Is(err, errContentVerification) && resumed && attempt == 1 {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		progress.update(progressId, "Pull complete")
+		return diffId, nil
+	}
+}
+
+// extractLayer extracts the layer blob read from body into the layer store.
+func extractLayer(layer layerDescriptor, compressor string, body io.Reader, progress *pullProgress) (string, error) {
+	verifier, err := newBlobVerifier(layer.Digest, layer.Size)
+	if err != nil {
+		return "", fmt.Errorf("error verifying layer %s: %w", layer.Digest, err)
+	}
+
+	tempDir, release, err := createExtractDir()
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	compressed := io.TeeReader(verifier.limit(body), verifier)
+
+	// Content that does not match its digest explains a broken archive or
+	// compressed stream better than the error reading it does.
+	explain := func(err error) error {
+		if _, copyErr := io.Copy(io.Discard, compressed); copyErr == nil {
+			if verifyErr := verifier.verify(); verifyErr != nil {
+				return verifyErr
+			}
+		}
+		return err
+	}
+
+	uncompressed, err := decompressStream(compressor, compressed)
+	if err != nil {
+		return "", fmt.Errorf("error decompressing layer %s: %w", layer.Digest, explain(err))
+	}
+	defer uncompressed.Close()
+
+	diffIdHash := sha256.New()
+	tarStream := &countingReader{Reader: io.TeeReader(uncompressed, diffIdHash)}
+
+	err = extractTar(tarStream, path.Join(tempDir, "rootfs"))
+	if err != nil {
+		return "", fmt.Errorf("error extracting layer %s: %w", layer.Digest, explain(err))
+	}
+
+	// The tar reader stops at the end-of-archive marker; the padding after it
+	// and anything left of the compressed stream still count for the digests.
+	_, err = io.Copy(io.Discard, tarStream)
+	if err == nil {
+		_, err = io.Copy(io.Discard, compressed)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading layer %s: %w", layer.Digest, explain(err))
+	}
+
+	progress.update(shortId(layer.Digest), "Verifying Checksum")
+	err = verifier.verify()
+	if err != nil {
+		return "", fmt.Errorf("layer %s failed verification: %w", layer.Digest, err)
+	}
+
+	diffId := "sha256:" + hex.EncodeToString(diffIdHash.Sum(nil))
+	if layer.DiffId != "" && diffId != layer.DiffId {
+		return "", fmt.Errorf("layer %s failed verification: %w: expected diff-ID %s, got %s", layer.Digest, errContentVerification, layer.DiffId, diffId)
+	}
+
+	if !layerExists(diffId) {
+		err = writeJSONFile(path.Join(tempDir, "layer.json"), layerRecord{DiffId: diffId, Digest: layer.Digest, Size: tarStream.count})
+		if err != nil {
+			return "", err
+		}
+
+		err = os.MkdirAll(path.Dir(layerPath(diffId)), 0755)
+		if err != nil {
+			return "", fmt.Errorf("error creating directory: %w", err)
+		}
+		// Losing the race against a concurrent pull of the same layer is fine.
+		if err = os.Rename(tempDir, layerPath(diffId)); err != nil && !layerExists(diffId) {
+			return "", fmt.Errorf("error storing layer %s: %w", diffId, err)
+		}
+	}
+
+	err = recordDiffId(layer.Digest, diffId)
+	if err != nil {
+		return "", fmt.Errorf("error recording layer %s: %w", diffId, err)
+	}
+
+	return diffId, nil
+}
+
+// extractDirPrefix starts the names of the temporary directories layers are
+// assembled in, under layerPathPrefix.
+const extractDirPrefix = ".extract-"
+
+// createExtractDir creates a temporary directory to assemble a layer in. The
+// directory stays locked against removeStaleExtractDirs until release, which
+// removes what is left of it.
+func createExtractDir() (string, func(), error) {
+	err := os.MkdirAll(layerPathPrefix, 0755)
+	if err != nil {
+		return "", nil, fmt.Errorf("error creating directory: %w", err)
+	}
+
+	for {
+		dir, err := os.MkdirTemp(layerPathPrefix, extractDirPrefix)
+		if err != nil {
+			return "", nil, fmt.Errorf("error creating directory: %w", err)
+		}
+		file, err := os.Open(dir)
+		if err == nil {
+			err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+			if err == nil {
+				_, err = os.Stat(dir)
+			}
+			if err != nil {
+				_ = file.Close()
+			}
+		}
+		// Another pull may have taken the directory for stale and removed it
+		// before it was locked.
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			_ = os.RemoveAll(dir)
+			return "", nil, fmt.Errorf("error locking directory: %w", err)
+		}
+
+		return dir, func() {
+			_ = os.RemoveAll(dir)
+			_ = file.Close()
+		}, nil
+	}
+}
+
+// removeStaleExtractDirs removes the temporary directories of layers whose
+// pull was killed before it could clean up, which nothing holds locked.
+func removeStaleExtractDirs() {
+	entries, err := os.ReadDir(layerPathPrefix)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), extractDirPrefix) {
+			continue
+		}
+		dir := path.Join(layerPathPrefix, entry.Name())
+		file, err := os.Open(dir)
+		if err != nil {
+			continue
+		}
+		if syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil {
+			_ = os.RemoveAll(dir)
+		}
+		_ = file.Close()
+	}
+}
+
+// decompressStream returns a reader of the uncompressed content of r.
+func decompressStream(compressor string, r io.Reader) (io.ReadCloser, error) {
+	switch compressor {
+	case "":
+		return io.NopCloser(r), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		return io.NopCloser(zstd.NewReader(r)), nil
+	default:
+		return nil, fmt.Errorf("unsupported compressor %s", compressor)
+	}
+}
+
+type countingReader struct {
+	io.Reader
+	count int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.count += int64(n)
+	return n, err
+}
+
+// blobStream reads a layer blob from the registry. When the transfer breaks
+// off it requests the rest of the blob, with a Range header, and carries on
+// where it stopped, so that the decompressor reading from it never notices.
+// What it reads is appended to a partial file under the ingest directory,
+// which the stream of a later pull reads back before requesting the rest.
+type blobStream struct {
+	ctx      context.Context
+	tokens   *authTokenSource
+	layer    layerDescriptor
+	progress *pullProgress
+
+	body       io.ReadCloser
+	offset     int64
+	attempts   int
+	downloaded bool
+
+	// partial is the locked partial file, nil if another pull holds it. Its
+	// first replay bytes are still to be read back.
+	partial *os.File
+	replay  int64
+}
+
+// openBlobStream opens a stream of the layer blob that starts with what an
+// earlier pull left in the ingest directory.
+func openBlobStream(ctx context.Context, layer layerDescriptor, tokens *authTokenSource, progress *pullProgress) (*blobStream, error) {
+	s := &blobStream{ctx: ctx, tokens: tokens, layer: layer, progress: progress}
+
+	partialPath := digestPath(ingestPathPrefix, layer.Digest)
+	err := os.MkdirAll(path.Dir(partialPath), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating directory: %w", err)
+	}
+	file, err := os.OpenFile(partialPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error creating file %s: %w", partialPath, err)
+	}
+	// A concurrent pull of the same layer owns the partial file; this one
+	// downloads without keeping what it reads.
+	if syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) != nil {
+		_ = file.Close()
+		return s, nil
+	}
+
+	info, err := file.Stat()
+	if err == nil && layer.Size > 0 && info.Size() > layer.Size {
+		err = file.Truncate(0)
+	} else if err == nil {
+		s.replay = info.Size()
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("error reading file %s: %w", partialPath, err)
+	}
+
+	s.partial = file
+	return s, nil
+}
+
+func (s *blobStream) Read(b []byte) (int, error) {
+	if s.replay > 0 {
+		if int64(len(b)) > s.replay {
+			b = b[:s.replay]
+		}
+		n, err := s.partial.Read(b)
+		s.replay -= int64(n)
+		s.offset += int64(n)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	}
+	if s.layer.Size > 0 && s.offset == s.layer.Size && s.body == nil {
+		s.setDownloaded()
+		return 0, io.EOF
+	}
+
+	for {
+		var n int
+		var err error
+		if s.body == nil {
+			err = s.open()
+		}
+		if err == nil {
+			n, err = s.body.Read(b)
+			s.offset += int64(n)
+			s.keep(b[:n])
+			if err == io.EOF && s.layer.Size > 0 && s.offset < s.layer.Size {
+				err = io.ErrUnexpectedEOF
+			}
+			if err == io.EOF || s.layer.Size > 0 && s.offset == s.layer.Size {
+				s.setDownloaded()
+			}
+			if err == nil || err == io.EOF {
+				return n, err
+			}
+			_ = s.closeBody()
+		}
+
+		if s.ctx.Err() != nil || s.attempts >= maxDownloadAttempts || errors.Is(err, errRangeNotSatisfiable) {
+			return n, err
+		}
+
+		delay := time.Duration(s.attempts) * downloadRetryDelay
+		s.progress.update(shortId(s.layer.Digest), fmt.Sprintf("Retrying in %s", delay))
+		select {
+		case <-time.After(delay):
+		case <-s.ctx.Done():
+			return n, s.ctx.Err()
+		}
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// keep appends what was read to the partial file. A partial file that cannot
+// be written to is given up on, which only costs the ability to resume.
+func (s *blobStream) keep(b []byte) {
+	if s.partial == nil || len(b) == 0 {
+		return
+	}
+	if _, err := s.partial.Write(b); err != nil {
+		s.discard()
+	}
+}
+
+// setDownloaded notes that the whole blob is in, which leaves extracting the
+// rest of it.
+func (s *blobStream) setDownloaded() {
+	if !s.downloaded {
+		s.downloaded = true
+		s.progress.update(shortId(s.layer.Digest), "Extracting")
+	}
+}
+
+// open requests the blob from the current offset on. A registry that ignores
+// the range sends the whole blob, whose start is then skipped.
+func (s *blobStream) open() error {
+	s.attempts++
+
+	authToken, err := s.tokens.get()
+	if err != nil {
+		return err
+	}
+
+	response, err := downloadManifestLayer(s.ctx, s.tokens.ref, s.layer.Digest, s.layer.MediaType, authToken, s.offset)
+	if err != nil {
+		return err
+	}
+
+	if s.offset > 0 && response.StatusCode != http.StatusPartialContent {
+		_, err = io.CopyN(io.Discard, response.Body, s.offset)
+		if err != nil {
+			_ = response.Body.Close()
+			return fmt.Errorf("error resuming layer %s: %w", s.layer.Digest, err)
+		}
+	}
+
+	s.body = s.progress.track(shortId(s.layer.Digest), response.Body, s.offset, s.layer.Size)
+	return nil
+}
+
+func (s *blobStream) closeBody() error {
+	if s.body == nil {
+		return nil
+	}
+	err := s.body.Close()
+	s.body = nil
+	return err
+}
+
+// Close ends the stream, keeping the partial file for a later pull.
+func (s *blobStream) Close() error {
+	if s.partial != nil {
+		_ = s.partial.Close()
+		s.partial = nil
+	}
+	return s.closeBody()
+}
+
+// discard ends the stream and removes the partial file, once the layer is
+// extracted or the blob has turned out to be bad.
+func (s *blobStream) discard() {
+	if s.partial != nil {
+		_ = os.Remove(s.partial.Name())
+	}
+	_ = s.Close()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testLayer is a gzip-compressed layer served by a test registry.
+type testLayer struct {
+	layerDescriptor
+	blob []byte
+}
+
+func newTestLayer(t *testing.T) testLayer {
+	t.Helper()
+	archive := buildTar(t,
+		testEntry{name: "etc/", typeflag: '5'},
+		testEntry{name: "etc/data", content: string(testBlob())},
+	)
+	diffIdHash := sha256.Sum256(archive.Bytes())
+
+	var blob bytes.Buffer
+	zw := gzip.NewWriter(&blob)
+	if _, err := zw.Write(archive.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return testLayer{
+		layerDescriptor: layerDescriptor{
+			Digest:    sha256Digest(blob.Bytes()),
+			MediaType: dockerLayerMediaType,
+			Size:      int64(blob.Len()),
+			DiffId:    "sha256:" + hex.EncodeToString(diffIdHash[:]),
+		},
+		blob: blob.Bytes(),
+	}
+}
+
+// writePartialDownload leaves content in the ingest directory the way an
+// interrupted pull of the layer does.
+func writePartialDownload(t *testing.T, digest string, content []byte) {
+	t.Helper()
+	partialPath := digestPath(ingestPathPrefix, digest)
+	err := os.MkdirAll(filepath.Dir(partialPath), 0755)
+	if err == nil {
+		err = os.WriteFile(partialPath, content, 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pullTestLayer(t *testing.T, registry *testRegistry, layer testLayer) {
+	t.Helper()
+	tokens := newAuthTokenSource(registry.ref(t, ""), registry.token(t))
+	diffId, err := pullLayer(context.Background(), layer.layerDescriptor, tokens, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffId != layer.DiffId {
+		t.Errorf("diff-ID = %s, want %s", diffId, layer.DiffId)
+	}
+
+	assertFileContent(t, filepath.Join(layerRootFsPath(diffId), "etc/data"), string(testBlob()))
+	assertNotExist(t, digestPath(ingestPathPrefix, layer.Digest))
+}
+
+func TestPullLayerResumesPartialDownload(t *testing.T) {
+	useTempStore(t)
+	registry := newTestRegistry(t)
+	layer := newTestLayer(t)
+	kept := len(layer.blob) / 2
+	writePartialDownload(t, layer.Digest, layer.blob[:kept])
+
+	var recorder rangeRecorder
+	registry.handle("/v2/test/app/blobs/"+layer.Digest, func(w http.ResponseWriter, r *http.Request) {
+		recorder.record(r)
+		serveBlob(w, r, layer.blob)
+	})
+
+	pullTestLayer(t, registry, layer)
+	recorder.assert(t, fmt.Sprintf("bytes=%d-", kept))
+}
+
+func TestPullLayerKeepsInterruptedDownload(t *testing.T) {
+	useTempStore(t)
+	registry := newTestRegistry(t)
+	layer := newTestLayer(t)
+	const sent = 1000
+
+	// Cancelling the pull when it retries stands in for mydocker being
+	// killed after the transfer broke off.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var recorder rangeRecorder
+	registry.handle("/v2/test/app/blobs/"+layer.Digest, func(w http.ResponseWriter, r *http.Request) {
+		if recorder.record(r) > 1 {
+			cancel()
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(layer.blob)))
+		w.Write(layer.blob[:sent])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	})
+
+	tokens := newAuthTokenSource(registry.ref(t, ""), registry.token(t))
+	_, err := pullLayer(ctx, layer.layerDescriptor, tokens, nil)
+	if err == nil {
+		t.Fatal("pullLayer succeeded with the transfer broken off")
+	}
+
+	assertFileContent(t, digestPath(ingestPathPrefix, layer.Digest), string(layer.blob[:sent]))
+}
+
+func TestPullLayerRestartsBadPartialDownload(t *testing.T) {
+	useTempStore(t)
+	registry := newTestRegistry(t)
+	layer := newTestLayer(t)
+	kept := len(layer.blob) / 2
+	garbage := bytes.Repeat([]byte{0xff}, kept)
+	writePartialDownload(t, layer.Digest, garbage)
+
+	var recorder rangeRecorder
+	registry.handle("/v2/test/app/blobs/"+layer.Digest, func(w http.ResponseWriter, r *http.Request) {
+		recorder.record(r)
+		serveBlob(w, r, layer.blob)
+	})
+
+	pullTestLayer(t, registry, layer)
+	recorder.assert(t, fmt.Sprintf("bytes=%d-", kept), "")
+}
+
+func TestPullLayerRejectsMismatchedBlob(t *testing.T) {
+	useTempStore(t)
+	registry := newTestRegistry(t)
+	layer := newTestLayer(t)
+	tampered := append([]byte{}, layer.blob...)
+	tampered[len(tampered)/2] ^= 0xff
+
+	registry.handle("/v2/test/app/blobs/"+layer.Digest, func(w http.ResponseWriter, r *http.Request) {
+		serveBlob(w, r, tampered)
+	})
+
+	tokens := newAuthTokenSource(registry.ref(t, ""), registry.token(t))
+	_, err := pullLayer(context.Background(), layer.layerDescriptor, tokens, nil)
+	if !errors.Is(err, errContentVerification) {
+		t.Fatalf("err = %v, want errContentVerification", err)
+	}
+	if layerExists(layer.DiffId) {
+		t.Error("layer stored despite failing verification")
+	}
+	assertNotExist(t, digestPath(ingestPathPrefix, layer.Digest))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+func loginCmd(cmd *cliCommand, args []string) int {
+	var username, password string
+	var passwordStdin bool
+
+	flags := cmd.flagSet()
+	flags.StringVar(&username, "u", "", "Username")
+	flags.StringVar(&username, "username", "", "Username")
+	flags.StringVar(&password, "p", "", "Password")
+	flags.StringVar(&password, "password", "", "Password")
+	flags.BoolVar(&passwordStdin, "password-stdin", false, "Take the password from stdin")
+	if code, ok := cmd.parseFlags(flags, args, 0, 1); !ok {
+		return code
+	}
+
+	registry := defaultRegistry
+	if flags.NArg() == 1 {
+		registry = normalizeAuthKey(flags.Arg(0))
+	}
+
+	if password != "" && passwordStdin {
+		printError(cmd, fmt.Errorf("--password and --password-stdin are mutually exclusive"))
+		return 2
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+
+	if passwordStdin {
+		if username == "" {
+			printError(cmd, fmt.Errorf("must provide --username with --password-stdin"))
+			return 2
+		}
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			printError(cmd, err)
+			return 1
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	}
+
+	if username == "" {
+		fmt.Print("Username: ")
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			printError(cmd, fmt.Errorf("error reading username: %w", err))
+			return 1
+		}
+		username = strings.TrimSpace(line)
+	}
+
+	if password == "" {
+		fmt.Print("Password: ")
+		line, err := readPassword(stdin)
+		fmt.Println()
+		if err != nil {
+			printError(cmd, fmt.Errorf("error reading password: %w", err))
+			return 1
+		}
+		password = line
+	}
+
+	if username == "" || password == "" {
+		printError(cmd, fmt.Errorf("username and password are required"))
+		return 1
+	}
+
+	creds := registryCredentials{Username: username, Password: password}
+	if err := verifyCredentials(registry, creds); err != nil {
+		printError(cmd, err)
+		return 1
+	}
+
+	if err := storeCredentials(registry, creds); err != nil {
+		printError(cmd, err)
+		return 1
+	}
+
+	fmt.Println("Login Succeeded")
+	return 0
+}
+
+func logoutCmd(cmd *cliCommand, args []string) int {
+	flags := cmd.flagSet()
+	if code, ok := cmd.parseFlags(flags, args, 0, 1); !ok {
+		return code
+	}
+
+	registry := defaultRegistry
+	if flags.NArg() == 1 {
+		registry = normalizeAuthKey(flags.Arg(0))
+	}
+
+	removed, err := removeCredentials(registry)
+	if err != nil {
+		printError(cmd, err)
+		return 1
+	}
+
+	if !removed {
+		fmt.Printf("Not logged in to %s\n", registry)
+		return 0
+	}
+
+	fmt.Printf("Removing login credentials for %s\n", registry)
+	return 0
+}
+
+// verifyCredentials checks creds against registry by authenticating and then
+// requesting the API root with the resulting authorization.
+func verifyCredentials(registry string, creds registryCredentials) error {
+	token, err := authenticate(registry, "", creds)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf(registryPingUrl, registryBaseUrl(registry)), nil)
+	if err != nil {
+		return fmt.Errorf("error creating login request: %w", err)
+	}
+	setAuthorization(req, token)
+
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error logging in to %s: %w", registry, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("unauthorized: incorrect username or password for %s", registry)
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("error logging in to %s: %s", registry, response.Status)
+	}
+
+	return nil
+}
+
+// readPassword reads a line from stdin with terminal echo turned off. When
+// stdin is not a terminal the line is read as is.
+func readPassword(stdin *bufio.Reader) (string, error) {
+	fd := os.Stdin.Fd()
+
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	if errno == 0 {
+		noEcho := termios
+		noEcho.Lflag &^= syscall.ECHO
+		noEcho.Lflag |= syscall.ICANON | syscall.ISIG
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&noEcho)))
+		if errno != 0 {
+			return "", errno
+		}
+		defer syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&termios)))
+	}
+
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -1,35 +1,23 @@
 package main
 
 import (
-	"fmt"
 	"os"
 )
 
 func main() {
-	image := os.Args[2]
-	commandName := os.Args[3]
-	args := os.Args[4:]
-
-	imageId, err := resolveImageDigest(image)
-	if err != nil {
-		fmt.Printf("Error resolving image digest: %v\n", err)
-		os.Exit(1)
+	if os.Args[0] == containerInitArg {
+		os.Exit(containerInit())
 	}
-
-	imagePath := fmt.Sprintf("%s/%s", imageLayerPathPrefix, imageId)
-
-	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
-		_, pullErr := pullImage(image)
-		if pullErr != nil {
-			fmt.Printf("Error fetching image: %v\n", err)
-			os.Exit(1)
-		}
+	if os.Args[0] == containerExecPath {
+		os.Exit(containerExec())
+	}
+	if os.Args[0] == supervisorArg {
+		os.Exit(supervise())
 	}
 
-	exitCode, err := runCommand(imageId, commandName, args)
-	if err != nil {
-		fmt.Printf("Error running command: %v\n", err)
+	if code, done := enterRootlessNamespace(); done {
+		os.Exit(code)
 	}
 
-	os.Exit(exitCode)
+	os.Exit(dispatch(os.Args[1:]))
 }
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Config struct {
@@ -84,51 +89,77 @@ type ImageManifestV2 struct {
 	Layers        []Layer
 }
 
+type ImageConfig struct {
+	Architecture string          `json:"architecture"`
+	Os           string          `json:"os"`
+	Created      time.Time       `json:"created"`
+	Config       ContainerConfig `json:"config"`
+	RootFS       ImageRootFS     `json:"rootfs"`
+}
+
+// ContainerConfig holds the defaults for containers run from an image.
+type ContainerConfig struct {
+	User       string   `json:"User"`
+	Env        []string `json:"Env"`
+	Entrypoint []string `json:"Entrypoint"`
+	Cmd        []string `json:"Cmd"`
+	WorkingDir string   `json:"WorkingDir"`
+}
+
+type ImageRootFS struct {
+	Type    string   `json:"type"`
+	DiffIds []string `json:"diff_ids"`
+}
+
 type Layer struct {
 	MediaType string `json:"mediaType"`
 	Size      int    `json:"size"`
 	Digest    string `json:"digest"`
 }
 
-func requestManifest(image, imageTag, targetOs, targetArch string, authToken AuthToken) (interface{}, error) {
+// requestManifest fetches the manifest ref points to, resolving image indexes
+// to the manifest for targetOs/targetArch. The returned digest is the digest
+// of the manifest or index that ref points to.
+func requestManifest(ref imageReference, targetOs, targetArch string, authToken AuthToken) (interface{}, string, error) {
 	var err error
 	var manifest ImageManifestV2
 	if isAuthTokenExpired(authToken) {
-		authToken, err = refreshAuthToken(image)
+		authToken, err = refreshAuthToken(ref)
 		if err != nil {
-			return manifest, fmt.Errorf("Error refreshing auth token: %v\n", err)
+			return manifest, "", fmt.Errorf("error refreshing auth token: %w", err)
 		}
 	}
 
-	req, err := createManifestRequest(image, imageTag, authToken, imageIndexMediaType)
+	req, err := createManifestRequest(ref, ref.Reference(), authToken, manifestAcceptHeader)
 	if err != nil {
-		return manifest, err
+		return manifest, "", err
 	}
 
-	response, err := handleManifestResponse(req)
+	response, digest, err := handleManifestResponse(req, ref.Digest)
 	if err != nil {
-		return manifest, err
+		return manifest, "", err
 	}
 
 	switch response.(type) {
 	case ImageManifestV1:
-		return response.(ImageManifestV1), nil
+		return response.(ImageManifestV1), digest, nil
 	case ImageManifestV2:
-		return response.(ImageManifestV2), nil
+		return response.(ImageManifestV2), digest, nil
 	case ImageIndex:
-		return handleImageIndexResponse(response.(ImageIndex), targetOs, targetArch, image, authToken)
+		target, err := handleImageIndexResponse(response.(ImageIndex), targetOs, targetArch, ref, authToken)
+		return target, digest, err
 	}
 
-	return manifest, fmt.Errorf("no manifest found for %s/%s", targetOs, targetArch)
+	return manifest, "", fmt.Errorf("no manifest found for %s/%s", targetOs, targetArch)
 }
 
-func downloadAndParseTargetManifest(targetDigest, image string, authToken AuthToken) (interface{}, error) {
-	req, err := createManifestRequest(image, targetDigest, authToken, "application/vnd.oci.image.manifest.v1+json")
+func downloadAndParseTargetManifest(targetDigest string, ref imageReference, authToken AuthToken) (interface{}, error) {
+	req, err := createManifestRequest(ref, targetDigest, authToken, manifestAcceptHeader)
 	if err != nil {
 		return nil, err
 	}
 
-	response, err := handleManifestResponse(req)
+	response, _, err := handleManifestResponse(req, targetDigest)
 	if err != nil {
 		return nil, err
 	}
@@ -142,32 +173,54 @@ func downloadAndParseTargetManifest(targetDigest, image string, authToken AuthTo
 	return nil, fmt.Errorf("no target manifest found for specified OS and architecture")
 }
 
-func createManifestRequest(image, digest string, authToken AuthToken, acceptHeader string) (*http.Request, error) {
-	fmtImageName := fmt.Sprintf("library/%s", image)
-	fmtManifestUrl := fmt.Sprintf(manifestUrl, fmtImageName, digest)
+func createManifestRequest(ref imageReference, digest string, authToken AuthToken, acceptHeader string) (*http.Request, error) {
+	fmtManifestUrl := fmt.Sprintf(manifestUrl, registryBaseUrl(ref.Registry), ref.Repository, digest)
 	req, err := http.NewRequest("GET", fmtManifestUrl, nil)
 	if err != nil {
-		return nil, fmt.Errorf("Error creating request: %v\n", err)
+		return nil, fmt.Errorf("error creating request: %w", err)
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", authToken.AccessToken))
+	setAuthorization(req, authToken)
 	req.Header.Set("Accept", acceptHeader)
 	return req, nil
 }
 
-func handleManifestResponse(req *http.Request) (interface{}, error) {
+// handleManifestResponse performs req and decodes the manifest it returns.
+// When expectedDigest is set the manifest bytes must hash to it, so content
+// pinned by digest cannot be swapped by the registry or anything in between.
+func handleManifestResponse(req *http.Request, expectedDigest string) (interface{}, string, error) {
 	response, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error requesting manifest: %v\n", err)
+		return nil, "", fmt.Errorf("error requesting manifest: %w", err)
 	}
 	defer response.Body.Close()
 	if response.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("error downloading manifest: %s", response.Status)
+		return nil, "", fmt.Errorf("error downloading manifest: %s", response.Status)
+	}
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	digest := response.Header.Get("Docker-Content-Digest")
+	if expectedDigest != "" {
+		if err := verifyDigest(expectedDigest, body); err != nil {
+			return nil, "", fmt.Errorf("manifest %s failed verification: %w", expectedDigest, err)
+		}
+		digest = expectedDigest
+	} else if digest == "" {
+		digest, _ = computeDigest("sha256:", body)
+	}
+
+	responseContentType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid manifest content type: %w", err)
 	}
-	responseContentType := response.Header.Get("Content-Type")
-	return unpackManifestResponse(responseContentType, response.Body)
+	manifest, err := unpackManifestResponse(responseContentType, io.NopCloser(bytes.NewReader(body)))
+	return manifest, digest, err
 }
 
-func handleImageIndexResponse(imageIndex ImageIndex, targetOs, targetArch, image string, authToken AuthToken) (interface{}, error) {
+func handleImageIndexResponse(imageIndex ImageIndex, targetOs, targetArch string, ref imageReference, authToken AuthToken) (interface{}, error) {
 	var targetDigest string
 	for _, m := range imageIndex.Manifests {
 		mp := m.Platform
@@ -177,224 +230,382 @@ func handleImageIndexResponse(imageIndex ImageIndex, targetOs, targetArch, image
 		}
 	}
 	if targetDigest != "" {
-		return downloadAndParseTargetManifest(targetDigest, image, authToken)
+		return downloadAndParseTargetManifest(targetDigest, ref, authToken)
 	}
 	return nil, fmt.Errorf("no target manifest found for %s/%s", targetOs, targetArch)
 }
 
-func downloadV1ManifestLayers(manifest ImageManifestV1, image string, authToken AuthToken) ([]string, error) {
-	var fetchedLayers []string
-	var metadata ImageManifestV1Metadata
-	err := json.Unmarshal([]byte(manifest.History[0].V1Compatibility), &metadata)
-	if err != nil {
-		return nil, fmt.Errorf("Error parsing manifest metadata: %v\n", err)
+// layerDescriptor is a manifest layer in the form shared by schema 1 and
+// schema 2 manifests. DiffId is the digest of the uncompressed layer when the
+// image config lists it, and empty otherwise.
+type layerDescriptor struct {
+	Digest    string
+	MediaType string
+	Size      int64
+	DiffId    string
+}
+
+func downloadV1ManifestLayers(manifest ImageManifestV1, ref imageReference, authToken AuthToken, progress *pullProgress, concurrency int) ([]string, error) {
+	// Schema 1 manifests list the topmost layer first.
+	var layers []layerDescriptor
+	for i := len(manifest.FsLayers) - 1; i >= 0; i-- {
+		layers = append(layers, layerDescriptor{
+			Digest:    manifest.FsLayers[i].BlobSum,
+			MediaType: v1ManifestLayerMediaType,
+		})
 	}
-	imageId := metadata.ID
 
-	for _, layer := range manifest.FsLayers {
-		var err error
-		var compressedLayerFilename string
-		var packedLayerFilename string
+	return downloadLayers(layers, ref, authToken, progress, concurrency)
+}
 
-		if isAuthTokenExpired(authToken) {
-			authToken, err = refreshAuthToken(image)
-			if err != nil {
-				return nil, fmt.Errorf("Error refreshing auth token: %v\n", err)
-			}
+func downloadV2ManifestLayers(manifest ImageManifestV2, diffIds []string, ref imageReference, authToken AuthToken, progress *pullProgress, concurrency int) ([]string, error) {
+	if len(diffIds) != 0 && len(diffIds) != len(manifest.Layers) {
+		return nil, fmt.Errorf("image config lists %d layers but the manifest has %d", len(diffIds), len(manifest.Layers))
+	}
+
+	var layers []layerDescriptor
+	for i, layer := range manifest.Layers {
+		descriptor := layerDescriptor{
+			Digest:    layer.Digest,
+			MediaType: layer.MediaType,
+			Size:      int64(layer.Size),
 		}
+		if len(diffIds) != 0 {
+			descriptor.DiffId = diffIds[i]
+		}
+		layers = append(layers, descriptor)
+	}
 
-		fmtImageName := fmt.Sprintf("library/%s", image)
-		layerResponse, err := downloadManifestLayer(fmtImageName, layer.BlobSum, v1ManifestLayerMediaType, authToken)
-		if err != nil {
-			return nil, err
+	return downloadLayers(layers, ref, authToken, progress, concurrency)
+}
+
+// layerDownload tracks the download of one layer. done is closed once the
+// layer is in the layer store, with diffId set, or err is set.
+type layerDownload struct {
+	done   chan struct{}
+	diffId string
+	err    error
+}
+
+// downloadLayers makes sure every layer is extracted in the layer store and
+// returns their diff-IDs in order. Layers already extracted for any image are
+// not downloaded again. Up to concurrency layers are downloaded and extracted
+// at once. The first failure cancels all other downloads.
+func downloadLayers(layers []layerDescriptor, ref imageReference, authToken AuthToken, progress *pullProgress, concurrency int) ([]string, error) {
+	if concurrency <= 0 {
+		concurrency = defaultMaxConcurrentDownloads
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var failureMu sync.Mutex
+	var failure error
+	fail := func(err error) {
+		failureMu.Lock()
+		defer failureMu.Unlock()
+		if failure == nil {
+			failure = err
+			cancel()
 		}
-		defer layerResponse.Body.Close()
+	}
+	failed := func() error {
+		failureMu.Lock()
+		defer failureMu.Unlock()
+		return failure
+	}
 
-		fileType, compressor, filename := getLayerFileInfo(layer.BlobSum, v1ManifestLayerMediaType)
-		filePath := fmt.Sprintf("%s/%s", imageLayerPathPrefix, imageId)
+	tokens := newAuthTokenSource(ref, authToken)
+	semaphore := make(chan struct{}, concurrency)
+	downloads := map[string]*layerDownload{}
+	diffIds := make([]string, len(layers))
 
-		err = storeLayer(filePath, filename, layerResponse)
-		if err != nil {
-			return nil, err
+	for i, layer := range layers {
+		progressId := shortId(layer.Digest)
+
+		diffId := layer.DiffId
+		if diffId == "" {
+			diffId, _ = lookupDiffId(layer.Digest)
+		}
+		if diffId != "" && layerExists(diffId) {
+			progress.update(progressId, "Already exists")
+			diffIds[i] = diffId
+			continue
 		}
 
-		filename, err = decompressLayer(compressor, compressedLayerFilename, filename, filePath)
-		if err != nil {
-			return nil, err
+		if _, ok := downloads[layer.Digest]; ok {
+			continue
 		}
+		download := &layerDownload{done: make(chan struct{})}
+		downloads[layer.Digest] = download
+		progress.update(progressId, "Waiting")
+
+		go func(layer layerDescriptor, download *layerDownload) {
+			defer close(download.done)
+
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-ctx.Done():
+				download.err = ctx.Err()
+				return
+			}
 
-		_, err = unpackLayer(fileType, packedLayerFilename, filename, filePath, layer)
-		if err != nil {
-			return nil, err
+			download.diffId, download.err = pullLayer(ctx, layer, tokens, progress)
+			if download.err != nil {
+				fail(download.err)
+			}
+		}(layer, download)
+	}
+
+	for i, layer := range layers {
+		if diffIds[i] != "" {
+			continue
 		}
 
-		fetchedLayers = append(fetchedLayers, layer.BlobSum)
+		download := downloads[layer.Digest]
+		<-download.done
+		diffIds[i] = download.diffId
 	}
 
-	return fetchedLayers, nil
-}
+	if err := failed(); err != nil {
+		return nil, err
+	}
 
-func downloadV2ManifestLayers(manifest ImageManifestV2, image string, authToken AuthToken) ([]string, error) {
-	var fetchedLayers []string
-	imageId := manifest.Config.Digest
+	return diffIds, nil
+}
 
-	for _, layer := range manifest.Layers {
-		var err error
-		var compressedLayerFilename string
-		var packedLayerFilename string
+// fetchBlob downloads a blob, such as an image config, into the blob store
+// unless it is already there. Bytes are collected in a partial file under the
+// ingest directory, so an interrupted download, in this or an earlier pull,
+// resumes where it stopped when the registry supports range requests. Failed
+// transfers are retried; content that fails verification is discarded.
+func fetchBlob(ctx context.Context, tokens *authTokenSource, digest, mediaType string, size int64) error {
+	if blobExists(digest) {
+		return nil
+	}
 
-		if isAuthTokenExpired(authToken) {
-			authToken, err = refreshAuthToken(image)
-			if err != nil {
-				return nil, fmt.Errorf("Error refreshing auth token: %v\n", err)
-			}
+	var err error
+	for attempt := 1; attempt <= maxDownloadAttempts; attempt++ {
+		verificationFailed := errors.Is(err, errContentVerification)
+		err = resumeBlobDownload(ctx, tokens, digest, mediaType, size)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		// A bad partial file from an earlier pull is discarded and fetched
+		// again once; content that fails twice will not get any better.
+		if verificationFailed && errors.Is(err, errContentVerification) {
+			break
+		}
+		if attempt == maxDownloadAttempts {
+			break
 		}
 
-		fmtImageName := fmt.Sprintf("library/%s", image)
-		layerResponse, err := downloadManifestLayer(fmtImageName, layer.Digest, layer.MediaType, authToken)
-		if err != nil {
-			return nil, err
+		select {
+		case <-time.After(time.Duration(attempt) * downloadRetryDelay):
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		defer layerResponse.Body.Close()
+	}
 
-		fileType, compressor, filename := getLayerFileInfo(layer.Digest, layer.MediaType)
-		filePath := fmt.Sprintf("%s/%s", imageLayerPathPrefix, imageId)
+	return err
+}
 
-		err = storeLayer(filePath, filename, layerResponse)
-		if err != nil {
-			return nil, err
-		}
+// resumeBlobDownload makes a single attempt at completing the partial
+// download of a blob.
+func resumeBlobDownload(ctx context.Context, tokens *authTokenSource, digest, mediaType string, size int64) error {
+	partialPath := digestPath(ingestPathPrefix, digest)
 
-		filename, err = decompressLayer(compressor, compressedLayerFilename, filename, filePath)
-		if err != nil {
-			return nil, err
+	var offset int64
+	if info, err := os.Stat(partialPath); err == nil {
+		offset = info.Size()
+	}
+	if size > 0 && offset >= size {
+		// Either complete but never committed, or garbage. Verifying it
+		// costs less than downloading it again.
+		if storeBlob(partialPath, offset, nil, digest, size) == nil {
+			return nil
 		}
+		offset = 0
+	}
 
-		_, err = unpackLayer(fileType, packedLayerFilename, filename, filePath, layer)
-		if err != nil {
-			return nil, err
-		}
+	authToken, err := tokens.get()
+	if err != nil {
+		return err
+	}
+
+	layerResponse, err := downloadManifestLayer(ctx, tokens.ref, digest, mediaType, authToken, offset)
+	if errors.Is(err, errRangeNotSatisfiable) {
+		offset = 0
+		_ = os.Remove(partialPath)
+		layerResponse, err = downloadManifestLayer(ctx, tokens.ref, digest, mediaType, authToken, 0)
+	}
+	if err != nil {
+		return err
+	}
+	defer layerResponse.Body.Close()
 
-		fetchedLayers = append(fetchedLayers, layer.Digest)
+	if layerResponse.StatusCode != http.StatusPartialContent {
+		offset = 0
 	}
 
-	return fetchedLayers, nil
+	return storeBlob(partialPath, offset, layerResponse, digest, size)
 }
 
-func downloadManifestLayer(fmtImageName string, layerId string, acceptHeader string, authToken AuthToken) (*http.Response, error) {
-	layerUrl := fmt.Sprintf(blobUrl, fmtImageName, layerId)
-	req, err := http.NewRequest("GET", layerUrl, nil)
+// fetchImageConfig returns the image config blob described by config,
+// downloading it into the blob store unless it is already there.
+func fetchImageConfig(ref imageReference, config Config, authToken AuthToken) (ImageConfig, error) {
+	var imageConfig ImageConfig
+
+	tokens := newAuthTokenSource(ref, authToken)
+	err := fetchBlob(context.Background(), tokens, config.Digest, config.MediaType, int64(config.Size))
 	if err != nil {
-		return nil, fmt.Errorf("Error creating layer request: %v\n", err)
+		return imageConfig, err
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", authToken.AccessToken))
+	err = readJSONFile(blobPath(config.Digest), &imageConfig)
+	if err != nil {
+		return imageConfig, fmt.Errorf("error reading image config: %w", err)
+	}
+
+	return imageConfig, nil
+}
+
+// errRangeNotSatisfiable is returned when the registry rejects the range of
+// a resumed download, typically because the partial file is stale.
+var errRangeNotSatisfiable = errors.New("requested range not satisfiable")
+
+// downloadManifestLayer requests a blob from the registry. A positive offset
+// asks for the remainder of the blob from that byte on; the response is then
+// either 206 Partial Content or, if the registry ignores the range, the whole
+// blob.
+func downloadManifestLayer(ctx context.Context, ref imageReference, layerId string, acceptHeader string, authToken AuthToken, offset int64) (*http.Response, error) {
+	layerUrl := fmt.Sprintf(blobUrl, registryBaseUrl(ref.Registry), ref.Repository, layerId)
+	req, err := http.NewRequestWithContext(ctx, "GET", layerUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating layer request: %w", err)
+	}
+
+	setAuthorization(req, authToken)
 	req.Header.Set("Accept", acceptHeader)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
 
 	layerResponse, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error downloading layer: %v\n", err)
+		return nil, fmt.Errorf("error downloading layer: %w", err)
 	}
 
-	if layerResponse.StatusCode != http.StatusOK {
+	switch {
+	case layerResponse.StatusCode == http.StatusOK:
+		return layerResponse, nil
+	case layerResponse.StatusCode == http.StatusPartialContent && offset > 0:
+		start, ok := parseContentRangeStart(layerResponse.Header.Get("Content-Range"))
+		if !ok || start != offset {
+			_ = layerResponse.Body.Close()
+			return nil, fmt.Errorf("error downloading layer %s: unexpected Content-Range %q", layerId, layerResponse.Header.Get("Content-Range"))
+		}
+		return layerResponse, nil
+	case layerResponse.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		_ = layerResponse.Body.Close()
+		return nil, errRangeNotSatisfiable
+	default:
+		_ = layerResponse.Body.Close()
 		return nil, fmt.Errorf("error downloading layer %s: %s", layerId, layerResponse.Status)
 	}
-	return layerResponse, nil
 }
 
-func unpackLayer(fileType string, packedLayerFilename string, filename string, filePath string, layer interface{}) (string, error) {
-	var layerExtractDir string
-	switch layer.(type) {
-	case FsLayer:
-		layerExtractDir = path.Join(filePath, layer.(FsLayer).BlobSum, "rootfs")
-	case Layer:
-		layerExtractDir = path.Join(filePath, layer.(Layer).Digest, "rootfs")
+// parseContentRangeStart returns the first byte position of a Content-Range
+// header such as "bytes 100-199/200".
+func parseContentRangeStart(contentRange string) (int64, bool) {
+	spec, found := strings.CutPrefix(contentRange, "bytes ")
+	if !found {
+		return 0, false
 	}
-	if fileType == "tar" {
-		packedLayerFilename = filename
+	start, _, found := strings.Cut(spec, "-")
+	if !found {
+		return 0, false
+	}
+	value, err := strconv.ParseInt(start, 10, 64)
+	return value, err == nil
+}
 
-		err := os.MkdirAll(layerExtractDir, 0755)
-		if err != nil {
-			return "", fmt.Errorf("Error creating directory: %v\n", err)
-		}
+// storeBlob appends the body of layerResponse to the partial download at
+// partialPath, whose first offset bytes are already on disk, and verifies
+// while it streams that the whole blob hashes to digest and, when size is
+// positive, is exactly size bytes long. A verified blob is moved into the blob
+// store; one that fails verification is deleted. A nil layerResponse only
+// verifies what is on disk.
+func storeBlob(partialPath string, offset int64, layerResponse *http.Response, digest string, size int64) error {
+	err := os.MkdirAll(path.Dir(partialPath), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating directory: %w", err)
+	}
 
-		err = exec.Command("tar", "-xf", path.Join(filePath, filename), "-C", layerExtractDir).Run()
-		if err != nil {
-			return "", fmt.Errorf("Error extracting layer: %v\n", err)
-		}
+	verifier, err := newBlobVerifier(digest, size)
+	if err != nil {
+		return fmt.Errorf("error verifying blob %s: %w", digest, err)
+	}
 
-		err = os.Remove(path.Join(filePath, packedLayerFilename))
-		if err != nil {
-			return "", fmt.Errorf("Error removing packed layer: %v\n", err)
-		}
-	} else {
-		return "", fmt.Errorf("Unsupported file type: %s\n", fileType)
+	file, err := os.OpenFile(partialPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating file %s: %w", partialPath, err)
 	}
-	return layerExtractDir, nil
-}
+	defer file.Close()
 
-func decompressLayer(compressor string, compressedLayerFilename string, filename string, filePath string) (string, error) {
-	if compressor != "" {
-		compressedLayerFilename = filename
-		switch compressor {
-		case "gzip":
-			err := exec.Command("gzip", "-d", "-k", path.Join(filePath, filename)).Run()
-			if err != nil {
-				return "", fmt.Errorf("Error decompressing layer: %v\n", err)
-			}
-			filename = filename[:len(filename)-3]
-		case "zstd":
-			err := exec.Command("zstd", "-d", path.Join(filePath, filename)).Run()
-			if err != nil {
-				return "", fmt.Errorf("Error decompressing layer: %v\n", err)
-			}
-			filename = filename[:len(filename)-5]
-		default:
-			return "", fmt.Errorf("Unsupported compressor: %s\n", compressor)
-		}
+	discard := func(err error) error {
+		_ = file.Close()
+		_ = os.Remove(partialPath)
+		return fmt.Errorf("error saving blob %s: %w", digest, err)
+	}
 
-		err := os.Remove(path.Join(filePath, compressedLayerFilename))
+	// Hash the bytes kept from an earlier attempt before appending to them.
+	_, err = io.Copy(verifier, io.LimitReader(file, offset))
+	if err != nil {
+		return discard(err)
+	}
+	err = file.Truncate(verifier.written)
+	if err != nil {
+		return fmt.Errorf("error saving blob %s: %w", digest, err)
+	}
+
+	if layerResponse != nil {
+		_, err = io.Copy(io.MultiWriter(file, verifier), verifier.limit(layerResponse.Body))
+		if errors.Is(err, errContentVerification) {
+			return discard(err)
+		}
 		if err != nil {
-			return "", fmt.Errorf("Error removing compressed layer: %v\n", err)
+			// Keep what arrived so the next attempt can resume from it.
+			return fmt.Errorf("error saving blob %s: %w", digest, err)
 		}
 	}
-	return filename, nil
-}
 
-func storeLayer(filePath string, filename string, layerResponse *http.Response) error {
-	err := os.MkdirAll(filePath, 0755)
+	err = verifier.verify()
 	if err != nil {
-		return fmt.Errorf("Error creating directory: %v\n", err)
+		return discard(err)
 	}
-	writePath := path.Join(filePath, filename)
-	file, err := os.Create(writePath)
+
+	err = file.Close()
 	if err != nil {
-		return fmt.Errorf("Error creating file %s: %v\n", writePath, err)
+		return fmt.Errorf("error saving blob %s: %w", digest, err)
 	}
-	defer file.Close()
 
-	_, err = io.Copy(file, layerResponse.Body)
+	blobFile := blobPath(digest)
+	err = os.MkdirAll(path.Dir(blobFile), 0755)
 	if err != nil {
-		return fmt.Errorf("Error saving layer: %v\n", err)
+		return fmt.Errorf("error creating directory: %w", err)
 	}
 
-	return nil
+	return os.Rename(partialPath, blobFile)
 }
 
-func getLayerFileInfo(layerDigest, layerMediaType string) (string, string, string) {
-	var filetype, compressor, filename string
-
+func getLayerFileInfo(layerMediaType string) (string, string) {
 	switch layerMediaType {
-	case v1ManifestLayerMediaType:
-		filetype = "tar"
-		compressor = "gzip"
-		filename = fmt.Sprintf("%s.tar.gz", layerDigest)
-	default:
-		filetype, compressor = getFileTypeAndCompressor(layerMediaType)
-		filename = buildPackedLayerFilename(layerDigest, filetype, compressor)
+	case v1ManifestLayerMediaType, dockerLayerMediaType:
+		return "tar", "gzip"
 	}
-
-	return filetype, compressor, filename
+	return getFileTypeAndCompressor(layerMediaType)
 }
 
 func getFileTypeAndCompressor(layerMediaType string) (string, string) {
@@ -408,29 +619,6 @@ func getFileTypeAndCompressor(layerMediaType string) (string, string) {
 	return filetype, compressor
 }
 
-func buildPackedLayerFilename(layerDigest string, layerFileType, layerCompressor string) string {
-	fileExt0 := ""
-	fileExt1 := ""
-
-	switch layerFileType {
-	case "tar":
-		fileExt0 = "tar"
-	}
-
-	switch layerCompressor {
-	case "gzip":
-		fileExt1 = "gz"
-	case "zstd":
-		fileExt1 = "zst"
-	}
-
-	if fileExt1 == "" {
-		return fmt.Sprintf("%s.%s", layerDigest, fileExt0)
-	} else {
-		return fmt.Sprintf("%s.%s.%s", layerDigest, fileExt0, fileExt1)
-	}
-}
-
 func unpackManifestResponse(contentType string, body io.ReadCloser) (interface{}, error) {
 	defer body.Close()
 
@@ -449,7 +637,7 @@ func unpackManifestResponse(contentType string, body io.ReadCloser) (interface{}
 			return nil, err
 		}
 		return manifest, nil
-	case "application/vnd.oci.image.index.v1+json":
+	case "application/vnd.oci.image.index.v1+json", "application/vnd.docker.distribution.manifest.list.v2+json":
 		var manifest ImageIndex
 		decoder := json.NewDecoder(body)
 		if err := decoder.Decode(&manifest); err != nil {
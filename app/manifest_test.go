@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func assertFileContent(t *testing.T, filePath, want string) {
+	t.Helper()
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("reading %s: %v", filePath, err)
+	}
+	if string(data) != want {
+		t.Errorf("%s = %q, want %q", filePath, data, want)
+	}
+}
+
+func assertNotExist(t *testing.T, filePath string) {
+	t.Helper()
+	if _, err := os.Lstat(filePath); !os.IsNotExist(err) {
+		t.Errorf("%s exists, want it deleted (err = %v)", filePath, err)
+	}
+}
+
+// serveBlob serves blob, honoring Range headers.
+func serveBlob(w http.ResponseWriter, r *http.Request, blob []byte) {
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+}
+
+// rangeRecorder records the Range header of every request of a handler.
+type rangeRecorder struct {
+	mu     sync.Mutex
+	ranges []string
+}
+
+func (recorder *rangeRecorder) record(r *http.Request) int {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.ranges = append(recorder.ranges, r.Header.Get("Range"))
+	return len(recorder.ranges)
+}
+
+func (recorder *rangeRecorder) assert(t *testing.T, want ...string) {
+	t.Helper()
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if strings.Join(recorder.ranges, ",") != strings.Join(want, ",") {
+		t.Errorf("requests had Range headers %q, want %q", recorder.ranges, want)
+	}
+}
+
+func TestRequestManifestVerifiesPinnedDigest(t *testing.T) {
+	registry := newTestRegistry(t)
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json",` +
+		`"config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":2,"digest":"sha256:cafe"},"layers":[]}`)
+	registry.handle("/v2/test/app/manifests/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+		w.Write(manifest)
+	})
+	token := registry.token(t)
+
+	digest := sha256Digest(manifest)
+	_, resolved, err := requestManifest(registry.ref(t, "@"+digest), "linux", "amd64", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved != digest {
+		t.Errorf("digest = %s, want %s", resolved, digest)
+	}
+
+	other := sha256Digest([]byte("other"))
+	_, _, err = requestManifest(registry.ref(t, "@"+other), "linux", "amd64", token)
+	if err == nil || !strings.Contains(err.Error(), "failed verification") {
+		t.Fatalf("err = %v, want a verification failure", err)
+	}
+}
+
+func TestFetchBlobRejectsMismatchedContent(t *testing.T) {
+	useTempStore(t)
+	registry := newTestRegistry(t)
+	blob := []byte(`{"architecture":"amd64"}`)
+	digest := sha256Digest([]byte("something else"))
+	registry.handle("/v2/test/app/blobs/", func(w http.ResponseWriter, r *http.Request) {
+		serveBlob(w, r, blob)
+	})
+
+	tokens := newAuthTokenSource(registry.ref(t, ""), registry.token(t))
+	err := fetchBlob(context.Background(), tokens, digest, "application/vnd.docker.container.image.v1+json", int64(len(blob)))
+	if !errors.Is(err, errContentVerification) {
+		t.Fatalf("err = %v, want errContentVerification", err)
+	}
+	if blobExists(digest) {
+		t.Error("blob stored despite failing verification")
+	}
+	assertNotExist(t, digestPath(ingestPathPrefix, digest))
+}
+
+func TestStoreBlobRejectsMismatchedContent(t *testing.T) {
+	blob := []byte("blob content")
+	digest := sha256Digest(blob)
+	tampered := []byte("blob CONTENT")
+	tests := []struct {
+		name   string
+		served []byte
+		// err is part of the error message.
+		err string
+	}{
+		{"tampered", tampered, "digest mismatch"},
+		{"truncated", blob[:len(blob)-1], "size mismatch"},
+		{"oversized", append(append([]byte{}, blob...), '!'), "size mismatch"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := newTestRegistry(t)
+			registry.handle("/v2/test/app/blobs/", func(w http.ResponseWriter, r *http.Request) {
+				serveBlob(w, r, test.served)
+			})
+
+			ref := registry.ref(t, "")
+			response, err := downloadManifestLayer(context.Background(), ref, digest, dockerLayerMediaType, registry.token(t), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+
+			partialPath := filepath.Join(t.TempDir(), "partial")
+			err = storeBlob(partialPath, 0, response, digest, int64(len(blob)))
+			if !errors.Is(err, errContentVerification) || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("err = %v, want a verification failure containing %q", err, test.err)
+			}
+			assertNotExist(t, partialPath)
+		})
+	}
+}
+
+// testBlob returns a blob large enough to be sent in several pieces.
+func testBlob() []byte {
+	var blob bytes.Buffer
+	for i := 0; blob.Len() < 64<<10; i++ {
+		fmt.Fprintf(&blob, "line %d of the test blob\n", i)
+	}
+	return blob.Bytes()
+}
+
+func TestFetchBlobResumesInterruptedDownload(t *testing.T) {
+	useTempStore(t)
+	registry := newTestRegistry(t)
+	blob := testBlob()
+	digest := sha256Digest(blob)
+	const sent = 1000
+
+	var recorder rangeRecorder
+	registry.handle("/v2/test/app/blobs/"+digest, func(w http.ResponseWriter, r *http.Request) {
+		if recorder.record(r) > 1 {
+			serveBlob(w, r, blob)
+			return
+		}
+		// Break the first transfer off partway through.
+		w.Header().Set("Content-Length", fmt.Sprint(len(blob)))
+		w.Write(blob[:sent])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	})
+
+	tokens := newAuthTokenSource(registry.ref(t, ""), registry.token(t))
+	err := fetchBlob(context.Background(), tokens, digest, "application/octet-stream", int64(len(blob)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder.assert(t, "", fmt.Sprintf("bytes=%d-", sent))
+	assertFileContent(t, blobPath(digest), string(blob))
+	assertNotExist(t, digestPath(ingestPathPrefix, digest))
+}
+
+func TestFetchBlobRestartsWhenRangeIsIgnored(t *testing.T) {
+	useTempStore(t)
+	registry := newTestRegistry(t)
+	blob := testBlob()
+	digest := sha256Digest(blob)
+	const kept = 1000
+
+	// What an interrupted earlier pull left behind.
+	partialPath := digestPath(ingestPathPrefix, digest)
+	err := os.MkdirAll(filepath.Dir(partialPath), 0755)
+	if err == nil {
+		err = os.WriteFile(partialPath, blob[:kept], 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var recorder rangeRecorder
+	registry.handle("/v2/test/app/blobs/"+digest, func(w http.ResponseWriter, r *http.Request) {
+		recorder.record(r)
+		w.Write(blob)
+	})
+
+	tokens := newAuthTokenSource(registry.ref(t, ""), registry.token(t))
+	err = fetchBlob(context.Background(), tokens, digest, "application/octet-stream", int64(len(blob)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder.assert(t, fmt.Sprintf("bytes=%d-", kept))
+	assertFileContent(t, blobPath(digest), string(blob))
+}
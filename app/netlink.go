@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Network interfaces, addresses, routes and netfilter rules are configured
+// over netlink, with just enough of the protocol for what mydocker needs.
+
+// Attribute types missing from package syscall.
+const (
+	iflaInfoKind     = 1
+	iflaInfoData     = 2
+	iflaNetNsPid     = 19
+	vethInfoPeer     = 1
+	nlaFNested       = 0x8000
+	netlinkNetfilter = 12
+)
+
+type netlinkMessage struct {
+	Type  uint16
+	Flags uint16
+	Data  []byte
+}
+
+// netlinkAttr encodes a netlink attribute, padded to 4 bytes.
+func netlinkAttr(attrType uint16, value ...[]byte) []byte {
+	var data []byte
+	for _, v := range value {
+		data = append(data, v...)
+	}
+	attr := make([]byte, 4, 4+len(data)+3)
+	binary.NativeEndian.PutUint16(attr[0:2], uint16(4+len(data)))
+	binary.NativeEndian.PutUint16(attr[2:4], attrType)
+	attr = append(attr, data...)
+	for len(attr)%4 != 0 {
+		attr = append(attr, 0)
+	}
+	return attr
+}
+
+func netlinkString(attrType uint16, value string) []byte {
+	return netlinkAttr(attrType, append([]byte(value), 0))
+}
+
+func netlinkUint32(attrType uint16, value uint32) []byte {
+	return netlinkAttr(attrType, binary.NativeEndian.AppendUint32(nil, value))
+}
+
+// netlinkRequest sends messages as one datagram and waits for the kernel to
+// acknowledge those that ask for it. It returns the first error reported.
+func netlinkRequest(protocol int, messages ...netlinkMessage) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, protocol)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
+
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return os.NewSyscallError("bind", err)
+	}
+
+	var request []byte
+	pending := make(map[uint32]bool)
+	for i, message := range messages {
+		seq := uint32(i + 1)
+		header := make([]byte, syscall.NLMSG_HDRLEN)
+		binary.NativeEndian.PutUint32(header[0:4], uint32(syscall.NLMSG_HDRLEN+len(message.Data)))
+		binary.NativeEndian.PutUint16(header[4:6], message.Type)
+		binary.NativeEndian.PutUint16(header[6:8], message.Flags|syscall.NLM_F_REQUEST)
+		binary.NativeEndian.PutUint32(header[8:12], seq)
+		request = append(request, header...)
+		request = append(request, message.Data...)
+		if message.Flags&syscall.NLM_F_ACK != 0 {
+			pending[seq] = true
+		}
+	}
+
+	err = syscall.Sendto(fd, request, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return os.NewSyscallError("sendto", err)
+	}
+
+	// Errors echo the request, which may be larger than a page.
+	buf := make([]byte, 65536)
+	for len(pending) > 0 {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return os.NewSyscallError("recvfrom", err)
+		}
+		replies, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, reply := range replies {
+			if reply.Header.Type != syscall.NLMSG_ERROR || len(reply.Data) < 4 {
+				continue
+			}
+			delete(pending, reply.Header.Seq)
+			if code := int32(binary.NativeEndian.Uint32(reply.Data[0:4])); code != 0 {
+				return syscall.Errno(-code)
+			}
+		}
+	}
+
+	return nil
+}
+
+func routeRequest(messageType uint16, flags uint16, data ...[]byte) error {
+	message := netlinkMessage{Type: messageType, Flags: flags | syscall.NLM_F_ACK}
+	for _, d := range data {
+		message.Data = append(message.Data, d...)
+	}
+	return netlinkRequest(syscall.NETLINK_ROUTE, message)
+}
+
+// ifInfoMsg encodes the header of link messages.
+func ifInfoMsg(index int, flags, change uint32) []byte {
+	msg := make([]byte, syscall.SizeofIfInfomsg)
+	msg[0] = syscall.AF_UNSPEC
+	binary.NativeEndian.PutUint32(msg[4:8], uint32(index))
+	binary.NativeEndian.PutUint32(msg[8:12], flags)
+	binary.NativeEndian.PutUint32(msg[12:16], change)
+	return msg
+}
+
+// createBridge creates a bridge device. It is not an error for it to exist.
+func createBridge(name string) error {
+	err := routeRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL,
+		ifInfoMsg(0, 0, 0),
+		netlinkString(syscall.IFLA_IFNAME, name),
+		netlinkAttr(syscall.IFLA_LINKINFO, netlinkString(iflaInfoKind, "bridge")))
+	if err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("error creating bridge %s: %w", name, err)
+	}
+	return nil
+}
+
+// createVethPair creates a veth pair whose peer end is created right in the
+// network namespace of the process peerPid.
+func createVethPair(name, peerName string, peerPid int) error {
+	peer := netlinkAttr(vethInfoPeer,
+		ifInfoMsg(0, 0, 0),
+		netlinkString(syscall.IFLA_IFNAME, peerName),
+		netlinkUint32(iflaNetNsPid, uint32(peerPid)))
+	err := routeRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL,
+		ifInfoMsg(0, 0, 0),
+		netlinkString(syscall.IFLA_IFNAME, name),
+		netlinkAttr(syscall.IFLA_LINKINFO,
+			netlinkString(iflaInfoKind, "veth"),
+			netlinkAttr(iflaInfoData, peer)))
+	if err != nil {
+		return fmt.Errorf("error creating veth pair %s: %w", name, err)
+	}
+	return nil
+}
+
+func deleteLink(name string) error {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	return routeRequest(syscall.RTM_DELLINK, 0, ifInfoMsg(link.Index, 0, 0))
+}
+
+// setLinkUp brings up the interface name, attaching it to the bridge master
+// unless master is empty.
+func setLinkUp(name, master string) error {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("error bringing up %s: %w", name, err)
+	}
+
+	attrs := [][]byte{ifInfoMsg(link.Index, syscall.IFF_UP, syscall.IFF_UP)}
+	if master != "" {
+		masterLink, err := net.InterfaceByName(master)
+		if err != nil {
+			return fmt.Errorf("error attaching %s to %s: %w", name, master, err)
+		}
+		attrs = append(attrs, netlinkUint32(syscall.IFLA_MASTER, uint32(masterLink.Index)))
+	}
+
+	err = routeRequest(syscall.RTM_NEWLINK, 0, attrs...)
+	if err != nil {
+		return fmt.Errorf("error bringing up %s: %w", name, err)
+	}
+	return nil
+}
+
+// addAddress assigns address to the interface name. It is not an error for
+// the interface to have it already.
+func addAddress(name string, address *net.IPNet) error {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("error adding address to %s: %w", name, err)
+	}
+
+	prefixLength, _ := address.Mask.Size()
+	msg := make([]byte, syscall.SizeofIfAddrmsg)
+	msg[0] = syscall.AF_INET
+	msg[1] = byte(prefixLength)
+	binary.NativeEndian.PutUint32(msg[4:8], uint32(link.Index))
+
+	ip := address.IP.To4()
+	err = routeRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, msg,
+		netlinkAttr(syscall.IFA_LOCAL, ip),
+		netlinkAttr(syscall.IFA_ADDRESS, ip))
+	if err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("error adding address to %s: %w", name, err)
+	}
+	return nil
+}
+
+// addDefaultRoute routes all traffic without a more specific route through
+// gateway on the interface name.
+func addDefaultRoute(name string, gateway net.IP) error {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("error adding default route: %w", err)
+	}
+
+	msg := make([]byte, syscall.SizeofRtMsg)
+	msg[0] = syscall.AF_INET
+	msg[4] = syscall.RT_TABLE_MAIN
+	msg[5] = syscall.RTPROT_BOOT
+	msg[6] = syscall.RT_SCOPE_UNIVERSE
+	msg[7] = syscall.RTN_UNICAST
+
+	err = routeRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, msg,
+		netlinkAttr(syscall.RTA_GATEWAY, gateway.To4()),
+		netlinkUint32(syscall.RTA_OIF, uint32(link.Index)))
+	if err != nil {
+		return fmt.Errorf("error adding default route: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+)
+
+// Containers on the bridge network are connected to the host bridge by a
+// veth pair, get an address from bridgeSubnet and reach the outside through
+// the bridge, which holds the first address of the subnet, with their
+// traffic masqueraded as the host's.
+const (
+	bridgeName         = "mydocker0"
+	bridgeSubnet       = "172.18.0.0/16"
+	containerInterface = "eth0"
+)
+
+const (
+	networkNone   = "none"
+	networkHost   = "host"
+	networkBridge = "bridge"
+)
+
+// containerNetwork is the network configuration of a container, which init
+// applies in its network namespace.
+type containerNetwork struct {
+	Mode string `json:"mode"`
+	// Address, in CIDR notation, and Gateway are those of containerInterface
+	// on the bridge network.
+	Address string `json:"address,omitempty"`
+	Gateway string `json:"gateway,omitempty"`
+}
+
+// ipamState records the addresses of the bridge subnet in use, and by which
+// container.
+type ipamState struct {
+	Allocations map[string]string `json:"allocations"`
+}
+
+// parseNetworkMode validates a --network value. Rootless containers cannot
+// be attached to a host bridge and have no network by default.
+func parseNetworkMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		if isRootless() {
+			return networkNone, nil
+		}
+		return networkBridge, nil
+	case networkBridge:
+		if isRootless() {
+			return "", fmt.Errorf("bridge networking is not supported in rootless mode")
+		}
+		return mode, nil
+	case networkNone, networkHost:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid network mode %q: expected none, host or bridge", mode)
+	}
+}
+
+func bridgeNetwork() (*net.IPNet, net.IP) {
+	_, subnet, _ := net.ParseCIDR(bridgeSubnet)
+	gateway := nthAddress(subnet, 1)
+	return subnet, gateway
+}
+
+func nthAddress(subnet *net.IPNet, n uint32) net.IP {
+	return binary.BigEndian.AppendUint32(nil, binary.BigEndian.Uint32(subnet.IP.To4())+n)
+}
+
+// setupBridge creates the bridge unless it exists and makes sure forwarding
+// and masquerading are set up for it.
+func setupBridge() error {
+	subnet, gateway := bridgeNetwork()
+
+	err := createBridge(bridgeName)
+	if err != nil {
+		return err
+	}
+	err = addAddress(bridgeName, &net.IPNet{IP: gateway, Mask: subnet.Mask})
+	if err != nil {
+		return err
+	}
+	err = setLinkUp(bridgeName, "")
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0)
+	if err != nil {
+		return fmt.Errorf("error enabling IP forwarding: %w", err)
+	}
+
+	return setupMasquerade(subnet, bridgeName)
+}
+
+// allocateAddress reserves an address on the bridge network for the
+// container of the sandbox sandboxId. Addresses of sandboxes that are gone,
+// left behind by a crash, are reclaimed.
+func allocateAddress(sandboxId string) (containerNetwork, error) {
+	unlock, err := lockStore()
+	if err != nil {
+		return containerNetwork{}, err
+	}
+	defer unlock()
+
+	state, err := readIpamState()
+	if err != nil {
+		return containerNetwork{}, err
+	}
+	for address, owner := range state.Allocations {
+		if _, err := os.Stat(path.Join(sandboxPathPrefix, owner)); os.IsNotExist(err) {
+			delete(state.Allocations, address)
+		}
+	}
+
+	subnet, gateway := bridgeNetwork()
+	ones, bits := subnet.Mask.Size()
+	size := uint32(1) << (bits - ones)
+	// The network and broadcast addresses and the gateway are not for
+	// containers.
+	for n := uint32(2); n < size-1; n++ {
+		address := nthAddress(subnet, n).String()
+		if _, ok := state.Allocations[address]; ok {
+			continue
+		}
+
+		state.Allocations[address] = sandboxId
+		err = writeJSONFile(ipamPath(), state)
+		if err != nil {
+			return containerNetwork{}, fmt.Errorf("error allocating address: %w", err)
+		}
+		return containerNetwork{
+			Mode:    networkBridge,
+			Address: (&net.IPNet{IP: net.ParseIP(address), Mask: subnet.Mask}).String(),
+			Gateway: gateway.String(),
+		}, nil
+	}
+
+	return containerNetwork{}, fmt.Errorf("no address left in %s", bridgeSubnet)
+}
+
+// releaseAddress returns the address of a container to the pool.
+func releaseAddress(network containerNetwork) {
+	address, _, _ := strings.Cut(network.Address, "/")
+
+	unlock, err := lockStore()
+	if err == nil {
+		var state ipamState
+		state, err = readIpamState()
+		if err == nil {
+			delete(state.Allocations, address)
+			err = writeJSONFile(ipamPath(), state)
+		}
+		unlock()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error releasing address %s: %v\n", address, err)
+	}
+}
+
+func ipamPath() string {
+	return path.Join(networkPathPrefix, "ipam.json")
+}
+
+func readIpamState() (ipamState, error) {
+	var state ipamState
+	err := readJSONFile(ipamPath(), &state)
+	if err != nil && !os.IsNotExist(err) {
+		return state, err
+	}
+	if state.Allocations == nil {
+		state.Allocations = make(map[string]string)
+	}
+	return state, nil
+}
+
+// connectContainer attaches the network namespace of the container init
+// process pid to the bridge with a veth pair, whose container end is
+// containerInterface. The pair goes away with the namespace.
+func connectContainer(containerId string, pid int) error {
+	hostInterface := "veth" + containerId
+	if len(hostInterface) > ifNameSize-1 {
+		hostInterface = hostInterface[:ifNameSize-1]
+	}
+
+	err := createVethPair(hostInterface, containerInterface, pid)
+	if err != nil {
+		return err
+	}
+
+	err = setLinkUp(hostInterface, bridgeName)
+	if err != nil {
+		_ = deleteLink(hostInterface)
+		return err
+	}
+
+	return nil
+}
+
+// configureNetwork sets up the network namespace of a container from within.
+func configureNetwork(network containerNetwork) error {
+	if network.Mode == networkHost {
+		return nil
+	}
+
+	err := setLinkUp("lo", "")
+	if err != nil || network.Address == "" {
+		return err
+	}
+
+	ip, address, err := net.ParseCIDR(network.Address)
+	if err != nil {
+		return fmt.Errorf("invalid container address: %w", err)
+	}
+	address.IP = ip
+
+	err = addAddress(containerInterface, address)
+	if err == nil {
+		err = setLinkUp(containerInterface, "")
+	}
+	if err == nil {
+		err = addDefaultRoute(containerInterface, net.ParseIP(network.Gateway))
+	}
+	return err
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// NAT rules are kept in nftables tables of mydocker's own, programmed over
+// netlink in batches so that each change applies atomically. Values in
+// nftables attributes are big endian.
+const (
+	nfnlSubsysNftables = 10
+	nfnlMsgBatchBegin  = 0x10
+	nfnlMsgBatchEnd    = 0x11
+
+	nftMsgNewTable = 0
+	nftMsgDelTable = 2
+	nftMsgNewChain = 3
+	nftMsgNewRule  = 6
+
+	nftaTableName      = 1
+	nftaChainTable     = 1
+	nftaChainName      = 3
+	nftaChainHook      = 4
+	nftaChainType      = 7
+	nftaHookHooknum    = 1
+	nftaHookPriority   = 2
+	nftaRuleTable      = 1
+	nftaRuleChain      = 2
+	nftaRuleExpression = 4
+	nftaListElem       = 1
+	nftaExprName       = 1
+	nftaExprData       = 2
+	nftaDataValue      = 1
+
+	nftaMetaDreg       = 1
+	nftaMetaKey        = 2
+	nftaCmpSreg        = 1
+	nftaCmpOp          = 2
+	nftaCmpData        = 3
+	nftaPayloadDreg    = 1
+	nftaPayloadBase    = 2
+	nftaPayloadOffset  = 3
+	nftaPayloadLen     = 4
+	nftaBitwiseSreg    = 1
+	nftaBitwiseDreg    = 2
+	nftaBitwiseLen     = 3
+	nftaBitwiseMask    = 4
+	nftaBitwiseXor     = 5
+	nftaImmediateDreg  = 1
+	nftaImmediateData  = 2
+	nftaNatType        = 1
+	nftaNatFamily      = 2
+	nftaNatRegAddrMin  = 3
+	nftaNatRegProtoMin = 5
+	nftaFibDreg        = 1
+	nftaFibResult      = 2
+	nftaFibFlags       = 3
+
+	nftReg1                = 1
+	nftReg2                = 2
+	nftCmpEq               = 0
+	nftCmpNeq              = 1
+	nftMetaIifname         = 6
+	nftMetaOifname         = 7
+	nftMetaL4proto         = 16
+	nftPayloadNetworkHdr   = 1
+	nftPayloadTransportHdr = 2
+	nftNatDnat             = 1
+	nftFibResultAddrtype   = 3
+	nftFibFlagDaddr        = 2
+
+	nfInetPreRouting  = 0
+	nfInetPostRouting = 4
+	nfIpPriNatDst     = -100
+	nfIpPriNatSrc     = 100
+	ifNameSize        = 16
+)
+
+// nftTableName is the table holding the masquerading rule of the bridge.
+// The port forwarding rules of each container are in a table of their own,
+// named after the container, which goes away with the container.
+const nftTableName = "mydocker"
+
+func nftUint32(attrType uint16, value uint32) []byte {
+	return netlinkAttr(attrType, binary.BigEndian.AppendUint32(nil, value))
+}
+
+func nftData(attrType uint16, value []byte) []byte {
+	return netlinkAttr(nlaFNested|attrType, netlinkAttr(nftaDataValue, value))
+}
+
+func nftMessage(messageType uint16, flags uint16, attrs ...[]byte) netlinkMessage {
+	// The nfgenmsg header: address family, version and resource ID.
+	data := []byte{syscall.AF_INET, 0, 0, 0}
+	for _, attr := range attrs {
+		data = append(data, attr...)
+	}
+	return netlinkMessage{Type: nfnlSubsysNftables<<8 | messageType, Flags: flags | syscall.NLM_F_ACK, Data: data}
+}
+
+// nftBatch applies messages as one transaction.
+func nftBatch(messages ...netlinkMessage) error {
+	batchHeader := []byte{syscall.AF_UNSPEC, 0}
+	batchHeader = binary.BigEndian.AppendUint16(batchHeader, nfnlSubsysNftables)
+
+	batch := []netlinkMessage{{Type: nfnlMsgBatchBegin, Data: batchHeader}}
+	batch = append(batch, messages...)
+	batch = append(batch, netlinkMessage{Type: nfnlMsgBatchEnd, Data: batchHeader})
+	return netlinkRequest(netlinkNetfilter, batch...)
+}
+
+// nftReplaceTable returns the messages that create the table name afresh,
+// removing whatever it held before.
+func nftReplaceTable(name string) []netlinkMessage {
+	return []netlinkMessage{
+		nftMessage(nftMsgNewTable, syscall.NLM_F_CREATE, netlinkString(nftaTableName, name)),
+		nftMessage(nftMsgDelTable, 0, netlinkString(nftaTableName, name)),
+		nftMessage(nftMsgNewTable, syscall.NLM_F_CREATE, netlinkString(nftaTableName, name)),
+	}
+}
+
+func nftNatChain(table, name string, hook uint32, priority int32) netlinkMessage {
+	return nftMessage(nftMsgNewChain, syscall.NLM_F_CREATE,
+		netlinkString(nftaChainTable, table),
+		netlinkString(nftaChainName, name),
+		netlinkAttr(nlaFNested|nftaChainHook,
+			nftUint32(nftaHookHooknum, hook),
+			nftUint32(nftaHookPriority, uint32(priority))),
+		netlinkString(nftaChainType, "nat"))
+}
+
+func nftDeleteTable(name string) error {
+	return nftBatch(nftMessage(nftMsgDelTable, 0, netlinkString(nftaTableName, name)))
+}
+
+func nftRule(table, chain string, expressions ...[]byte) netlinkMessage {
+	return nftMessage(nftMsgNewRule, syscall.NLM_F_CREATE|syscall.NLM_F_APPEND,
+		netlinkString(nftaRuleTable, table),
+		netlinkString(nftaRuleChain, chain),
+		netlinkAttr(nlaFNested|nftaRuleExpression, expressions...))
+}
+
+func nftExpression(name string, attrs ...[]byte) []byte {
+	expression := [][]byte{netlinkString(nftaExprName, name)}
+	if len(attrs) > 0 {
+		expression = append(expression, netlinkAttr(nlaFNested|nftaExprData, attrs...))
+	}
+	return netlinkAttr(nlaFNested|nftaListElem, expression...)
+}
+
+func nftMeta(key uint32) []byte {
+	return nftExpression("meta", nftUint32(nftaMetaDreg, nftReg1), nftUint32(nftaMetaKey, key))
+}
+
+func nftCmp(op uint32, value []byte) []byte {
+	return nftExpression("cmp", nftUint32(nftaCmpSreg, nftReg1), nftUint32(nftaCmpOp, op), nftData(nftaCmpData, value))
+}
+
+func nftPayload(base, offset, length uint32) []byte {
+	return nftExpression("payload",
+		nftUint32(nftaPayloadDreg, nftReg1),
+		nftUint32(nftaPayloadBase, base),
+		nftUint32(nftaPayloadOffset, offset),
+		nftUint32(nftaPayloadLen, length))
+}
+
+func nftImmediate(register uint32, value []byte) []byte {
+	return nftExpression("immediate", nftUint32(nftaImmediateDreg, register), nftData(nftaImmediateData, value))
+}
+
+// nftLocalAddress matches packets to an address of the host, like
+//
+//	fib daddr type local
+func nftLocalAddress() [][]byte {
+	return [][]byte{
+		nftExpression("fib",
+			nftUint32(nftaFibDreg, nftReg1),
+			nftUint32(nftaFibResult, nftFibResultAddrtype),
+			nftUint32(nftaFibFlags, nftFibFlagDaddr)),
+		// The address type is compared in host byte order.
+		nftCmp(nftCmpEq, binary.NativeEndian.AppendUint32(nil, syscall.RTN_LOCAL)),
+	}
+}
+
+// nftDnat rewrites the destination of packets to address and port.
+func nftDnat(address net.IP, port uint16) [][]byte {
+	return [][]byte{
+		nftImmediate(nftReg1, address.To4()),
+		nftImmediate(nftReg2, binary.BigEndian.AppendUint16(nil, port)),
+		nftExpression("nat",
+			nftUint32(nftaNatType, nftNatDnat),
+			nftUint32(nftaNatFamily, syscall.AF_INET),
+			nftUint32(nftaNatRegAddrMin, nftReg1),
+			nftUint32(nftaNatRegProtoMin, nftReg2)),
+	}
+}
+
+func nftMask(mask []byte) []byte {
+	return nftExpression("bitwise",
+		nftUint32(nftaBitwiseSreg, nftReg1),
+		nftUint32(nftaBitwiseDreg, nftReg1),
+		nftUint32(nftaBitwiseLen, uint32(len(mask))),
+		nftData(nftaBitwiseMask, mask),
+		nftData(nftaBitwiseXor, make([]byte, len(mask))))
+}
+
+// nftIfName encodes an interface name the way nftables compares them.
+func nftIfName(name string) []byte {
+	value := make([]byte, ifNameSize)
+	copy(value, name)
+	return value
+}
+
+// setupMasquerade makes traffic from subnet leaving the host through any
+// interface but bridge appear to come from the host, like
+//
+//	ip saddr SUBNET oifname != BRIDGE masquerade
+func setupMasquerade(subnet *net.IPNet, bridge string) error {
+	messages := nftReplaceTable(nftTableName)
+	messages = append(messages,
+		nftNatChain(nftTableName, "postrouting", nfInetPostRouting, nfIpPriNatSrc),
+		nftRule(nftTableName, "postrouting",
+			// The source address is at offset 12 of the IPv4 header.
+			nftPayload(nftPayloadNetworkHdr, 12, 4),
+			nftMask(subnet.Mask),
+			nftCmp(nftCmpEq, subnet.IP.To4()),
+			nftMeta(nftMetaOifname),
+			nftCmp(nftCmpNeq, nftIfName(bridge)),
+			nftExpression("masq")))
+
+	err := nftBatch(messages...)
+	if err != nil {
+		return fmt.Errorf("error setting up NAT: %w", err)
+	}
+	return nil
+}
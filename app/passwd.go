@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// containerUser is the identity a container command runs as.
+type containerUser struct {
+	Uid    int
+	Gid    int
+	Groups []int
+	Home   string
+}
+
+// lookupContainerUser resolves a user of the form USER[:GROUP], with names or
+// numeric IDs, against /etc/passwd and /etc/group of the current root, which
+// is the container's by the time it is called. Like Docker, a numeric user
+// need not exist, and the user gets the supplementary groups it is listed in.
+func lookupContainerUser(spec string) (containerUser, error) {
+	userName, groupName, hasGroup := strings.Cut(spec, ":")
+	if userName == "" {
+		userName = "0"
+	}
+
+	user := containerUser{Home: "/"}
+	uid, numeric := parseId(userName)
+	found := false
+	err := scanColonFile("/etc/passwd", 7, func(fields []string) bool {
+		entryUid, _ := parseId(fields[2])
+		if fields[0] != userName && !(numeric && entryUid == uid) {
+			return false
+		}
+		userName = fields[0]
+		user.Uid = entryUid
+		user.Gid, _ = parseId(fields[3])
+		user.Home = fields[5]
+		found = true
+		return true
+	})
+	if err != nil {
+		return user, err
+	}
+	if !found {
+		if !numeric {
+			return user, fmt.Errorf("unable to find user %s: no matching entries in passwd file", userName)
+		}
+		user.Uid = uid
+	}
+
+	if hasGroup {
+		gid, numeric := parseId(groupName)
+		found := numeric
+		err = scanColonFile("/etc/group", 4, func(fields []string) bool {
+			if fields[0] != groupName {
+				return false
+			}
+			gid, _ = parseId(fields[2])
+			found = true
+			return true
+		})
+		if err != nil {
+			return user, err
+		}
+		if !found {
+			return user, fmt.Errorf("unable to find group %s: no matching entries in group file", groupName)
+		}
+		user.Gid = gid
+	}
+
+	err = scanColonFile("/etc/group", 4, func(fields []string) bool {
+		if gid, ok := parseId(fields[2]); ok && containsString(strings.Split(fields[3], ","), userName) {
+			user.Groups = append(user.Groups, gid)
+		}
+		return false
+	})
+	return user, err
+}
+
+func parseId(value string) (int, bool) {
+	id, err := strconv.Atoi(value)
+	return id, err == nil && id >= 0
+}
+
+// scanColonFile calls match with the fields of each entry of a passwd-style
+// file until it returns true. Malformed entries are skipped, and a missing
+// file has no entries.
+func scanColonFile(filePath string, fieldCount int, match func(fields []string) bool) error {
+	file, err := os.Open(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < fieldCount {
+			continue
+		}
+		if match(fields) {
+			return nil
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Published ports are forwarded the way Docker does by default. A userspace
+// proxy listens on each host port, which reserves the port and forwards
+// connections made from the host itself. Traffic from elsewhere is rewritten
+// to the container by DNAT rules, which keep the client's address. Without
+// nftables, the proxy forwards all traffic.
+
+// udpProxyTimeout is how long the UDP proxy keeps a client's flow without
+// traffic.
+const udpProxyTimeout = 90 * time.Second
+
+// The TCP proxy backs off from accepting after a temporary error, running out
+// of file descriptors or a connection aborted before it was accepted, the way
+// net/http does: starting at acceptMinDelay and doubling up to acceptMaxDelay
+// until a connection is accepted again.
+const (
+	acceptMinDelay = 5 * time.Millisecond
+	acceptMaxDelay = time.Second
+)
+
+// portMapping forwards HostIP:HostPort to ContainerPort of a container. A
+// nil HostIP stands for all host addresses.
+type portMapping struct {
+	HostIP        net.IP
+	HostPort      uint16
+	ContainerPort uint16
+	Protocol      string
+}
+
+func (m portMapping) String() string {
+	host := ""
+	if m.HostIP != nil {
+		host = m.HostIP.String()
+	}
+	return fmt.Sprintf("%s/%s", net.JoinHostPort(host, strconv.Itoa(int(m.HostPort))), m.Protocol)
+}
+
+// parsePortMapping parses a -p value of the form
+// [HOST_IP:]HOST_PORT:CONTAINER_PORT[/PROTOCOL].
+func parsePortMapping(value string) (portMapping, error) {
+	mapping := portMapping{Protocol: "tcp"}
+	invalid := func(reason string) error {
+		return fmt.Errorf("invalid port mapping %q: %s", value, reason)
+	}
+
+	ports, protocol, hasProtocol := strings.Cut(value, "/")
+	if hasProtocol {
+		if protocol != "tcp" && protocol != "udp" {
+			return mapping, invalid("protocol must be tcp or udp")
+		}
+		mapping.Protocol = protocol
+	}
+
+	parts := strings.Split(ports, ":")
+	if len(parts) == 3 {
+		mapping.HostIP = net.ParseIP(parts[0]).To4()
+		if mapping.HostIP == nil {
+			return mapping, invalid("host IP must be an IPv4 address")
+		}
+		parts = parts[1:]
+	}
+	if len(parts) != 2 {
+		return mapping, invalid("expected [HOST_IP:]HOST_PORT:CONTAINER_PORT[/PROTOCOL]")
+	}
+
+	for i, port := range []*uint16{&mapping.HostPort, &mapping.ContainerPort} {
+		number, err := strconv.ParseUint(parts[i], 10, 16)
+		if err != nil || number == 0 {
+			return mapping, invalid(fmt.Sprintf("%q is not a valid port", parts[i]))
+		}
+		*port = uint16(number)
+	}
+
+	return mapping, nil
+}
+
+// publishPorts forwards the host ports of mappings to the container with
+// address containerIP. The returned function releases the ports.
+func publishPorts(containerId string, containerIP net.IP, mappings []portMapping) (func(), error) {
+	var proxies []io.Closer
+	release := func() {
+		for _, proxy := range proxies {
+			_ = proxy.Close()
+		}
+	}
+
+	for _, mapping := range mappings {
+		proxy, err := startPortProxy(mapping, containerIP)
+		if err != nil {
+			release()
+			return nil, fmt.Errorf("error publishing port %s: %w", mapping, err)
+		}
+		proxies = append(proxies, proxy)
+	}
+
+	table := portTableName(containerId)
+	if addPortForwarding(table, containerIP, mappings) == nil {
+		releaseProxies := release
+		release = func() {
+			_ = nftDeleteTable(table)
+			releaseProxies()
+		}
+	}
+
+	return release, nil
+}
+
+func portTableName(containerId string) string {
+	return nftTableName + "-" + shortId(containerId)
+}
+
+// addPortForwarding adds DNAT rules for the mappings to the table, like
+//
+//	fib daddr type local iifname != BRIDGE tcp dport HOST_PORT dnat to CONTAINER_IP:CONTAINER_PORT
+//
+// Traffic from the bridge is left to the proxy, which makes the container
+// see replies come from where it sent its requests.
+func addPortForwarding(table string, containerIP net.IP, mappings []portMapping) error {
+	messages := nftReplaceTable(table)
+	messages = append(messages, nftNatChain(table, "prerouting", nfInetPreRouting, nfIpPriNatDst))
+
+	for _, mapping := range mappings {
+		var expressions [][]byte
+		if mapping.HostIP != nil {
+			// The destination address is at offset 16 of the IPv4 header.
+			expressions = append(expressions,
+				nftPayload(nftPayloadNetworkHdr, 16, 4),
+				nftCmp(nftCmpEq, mapping.HostIP))
+		} else {
+			expressions = append(expressions, nftLocalAddress()...)
+		}
+
+		protocol := byte(6)
+		if mapping.Protocol == "udp" {
+			protocol = 17
+		}
+		expressions = append(expressions,
+			nftMeta(nftMetaIifname),
+			nftCmp(nftCmpNeq, nftIfName(bridgeName)),
+			nftMeta(nftMetaL4proto),
+			nftCmp(nftCmpEq, []byte{protocol}),
+			// Both TCP and UDP have the destination port at offset 2.
+			nftPayload(nftPayloadTransportHdr, 2, 2),
+			nftCmp(nftCmpEq, []byte{byte(mapping.HostPort >> 8), byte(mapping.HostPort)}))
+		expressions = append(expressions, nftDnat(containerIP, mapping.ContainerPort)...)
+
+		messages = append(messages, nftRule(table, "prerouting", expressions...))
+	}
+
+	return nftBatch(messages...)
+}
+
+func startPortProxy(mapping portMapping, containerIP net.IP) (io.Closer, error) {
+	host := ""
+	if mapping.HostIP != nil {
+		host = mapping.HostIP.String()
+	}
+	hostAddress := net.JoinHostPort(host, strconv.Itoa(int(mapping.HostPort)))
+	containerAddress := net.JoinHostPort(containerIP.String(), strconv.Itoa(int(mapping.ContainerPort)))
+
+	if mapping.Protocol == "udp" {
+		conn, err := net.ListenPacket("udp4", hostAddress)
+		if err != nil {
+			return nil, err
+		}
+		go proxyUDP(conn, containerAddress)
+		return conn, nil
+	}
+
+	listener, err := net.Listen("tcp4", hostAddress)
+	if err != nil {
+		return nil, err
+	}
+	go proxyTCP(listener, containerAddress)
+	return listener, nil
+}
+
+// proxyTCP forwards each connection accepted on listener to the container
+// until the listener is closed or fails for good.
+func proxyTCP(listener net.Listener, containerAddress string) {
+	var delay time.Duration
+	for {
+		client, err := listener.Accept()
+		if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) || errors.Is(err, syscall.ECONNABORTED) {
+			if delay == 0 {
+				delay = acceptMinDelay
+			} else {
+				delay = min(2*delay, acceptMaxDelay)
+			}
+			time.Sleep(delay)
+			continue
+		}
+		if err != nil {
+			return
+		}
+		delay = 0
+
+		go func() {
+			defer client.Close()
+			container, err := net.Dial("tcp4", containerAddress)
+			if err != nil {
+				return
+			}
+			defer container.Close()
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go copyHalf(&wg, container, client)
+			go copyHalf(&wg, client, container)
+			wg.Wait()
+		}()
+	}
+}
+
+// copyHalf copies one direction of a TCP connection and passes the end of
+// it on, so that a client may close its sending side and still read the
+// response.
+func copyHalf(wg *sync.WaitGroup, dst, src net.Conn) {
+	defer wg.Done()
+	_, _ = io.Copy(dst, src)
+	if conn, ok := dst.(*net.TCPConn); ok {
+		_ = conn.CloseWrite()
+	}
+}
+
+// proxyUDP forwards datagrams from each client over a connection of its own
+// to the container, and the container's replies back to the client.
+func proxyUDP(conn net.PacketConn, containerAddress string) {
+	var mu sync.Mutex
+	flows := make(map[string]net.Conn)
+	buf := make([]byte, 65535)
+
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			mu.Lock()
+			for _, flow := range flows {
+				_ = flow.Close()
+			}
+			mu.Unlock()
+			return
+		}
+		if err != nil {
+			continue
+		}
+
+		mu.Lock()
+		flow, ok := flows[client.String()]
+		if !ok {
+			flow, err = net.Dial("udp4", containerAddress)
+			if err != nil {
+				mu.Unlock()
+				continue
+			}
+			flows[client.String()] = flow
+			go func() {
+				replies := make([]byte, 65535)
+				for {
+					_ = flow.SetReadDeadline(time.Now().Add(udpProxyTimeout))
+					n, err := flow.Read(replies)
+					if err != nil {
+						break
+					}
+					_, _ = conn.WriteTo(replies[:n], client)
+				}
+				mu.Lock()
+				delete(flows, client.String())
+				mu.Unlock()
+				_ = flow.Close()
+			}()
+		}
+		mu.Unlock()
+
+		_ = flow.SetReadDeadline(time.Now().Add(udpProxyTimeout))
+		_, _ = flow.Write(buf[:n])
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePortMapping(t *testing.T) {
+	tests := []struct {
+		value string
+		// want is the mapping as String formats it.
+		want string
+	}{
+		{"8080:80", ":8080/tcp"},
+		{"8080:80/tcp", ":8080/tcp"},
+		{"5353:53/udp", ":5353/udp"},
+		{"127.0.0.1:8080:80", "127.0.0.1:8080/tcp"},
+		{"0.0.0.0:8080:80/udp", "0.0.0.0:8080/udp"},
+		{"65535:1", ":65535/tcp"},
+	}
+	for _, test := range tests {
+		mapping, err := parsePortMapping(test.value)
+		if err != nil || mapping.String() != test.want {
+			t.Errorf("parsePortMapping(%q) = %s, %v, want %s", test.value, mapping, err, test.want)
+		}
+	}
+
+	mapping, err := parsePortMapping("127.0.0.1:8080:80/udp")
+	if err != nil || mapping.HostPort != 8080 || mapping.ContainerPort != 80 || mapping.Protocol != "udp" || mapping.HostIP.String() != "127.0.0.1" {
+		t.Errorf("parsePortMapping(%q) = %+v, %v", "127.0.0.1:8080:80/udp", mapping, err)
+	}
+}
+
+func TestParsePortMappingRejectsInvalidMappings(t *testing.T) {
+	tests := []struct {
+		value string
+		// err is part of the error message.
+		err string
+	}{
+		{"80", "expected [HOST_IP:]HOST_PORT:CONTAINER_PORT[/PROTOCOL]"},
+		{"1:2:3:4", "expected [HOST_IP:]HOST_PORT:CONTAINER_PORT[/PROTOCOL]"},
+		{"8080:80/sctp", "protocol must be tcp or udp"},
+		{"8080:80/", "protocol must be tcp or udp"},
+		{"::1:8080:80", "expected [HOST_IP:]HOST_PORT:CONTAINER_PORT[/PROTOCOL]"},
+		{"localhost:8080:80", "host IP must be an IPv4 address"},
+		{"0:80", `"0" is not a valid port`},
+		{"8080:65536", `"65536" is not a valid port`},
+		{"http:80", `"http" is not a valid port`},
+		{"8080-8081:80", `"8080-8081" is not a valid port`},
+		{":80", `"" is not a valid port`},
+	}
+	for _, test := range tests {
+		mapping, err := parsePortMapping(test.value)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("parsePortMapping(%q) = %s, %v, want an error containing %q", test.value, mapping, err, test.err)
+		}
+	}
+}
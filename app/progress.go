@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const progressRefreshInterval = 100 * time.Millisecond
+
+// pullProgress renders one status line per layer. On a terminal the lines are
+// redrawn in place; otherwise only phase changes are written, one per line.
+// A nil *pullProgress discards all updates.
+type pullProgress struct {
+	mu       sync.Mutex
+	out      io.Writer
+	terminal bool
+	order    []string
+	status   map[string]string
+	phase    map[string]string
+	redrawn  map[string]time.Time
+}
+
+func newPullProgress(out *os.File) *pullProgress {
+	return &pullProgress{
+		out:      out,
+		terminal: isTerminal(out),
+		status:   map[string]string{},
+		phase:    map[string]string{},
+		redrawn:  map[string]time.Time{},
+	}
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// update sets the status of the layer with the given id.
+func (p *pullProgress) update(id, status string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.setLocked(id, status, status)
+}
+
+// downloading reports that current of total bytes of the layer have been
+// fetched. A total of zero or less means the size is unknown.
+func (p *pullProgress) downloading(id string, current, total int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	done := total > 0 && current >= total
+	if !done && time.Since(p.redrawn[id]) < progressRefreshInterval {
+		return
+	}
+
+	status := fmt.Sprintf("Downloading  %s", humanSize(current))
+	if total > 0 {
+		status = fmt.Sprintf("Downloading  %s/%s", humanSize(current), humanSize(total))
+	}
+	p.setLocked(id, "Downloading", status)
+}
+
+// message writes a line that is not tied to any layer below the layer lines.
+func (p *pullProgress) message(format string, args ...interface{}) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fmt.Fprintf(p.out, format+"\n", args...)
+	// Anything printed after the layer lines would be overwritten by a redraw.
+	p.order = nil
+}
+
+// track wraps body so that reads from it are reported as download progress,
+// counting from offset bytes for resumed downloads.
+func (p *pullProgress) track(id string, body io.ReadCloser, offset, total int64) io.ReadCloser {
+	if p == nil {
+		return body
+	}
+	return &progressReader{ReadCloser: body, progress: p, id: id, current: offset, total: total}
+}
+
+func (p *pullProgress) setLocked(id, phase, status string) {
+	index := -1
+	for i, existing := range p.order {
+		if existing == id {
+			index = i
+			break
+		}
+	}
+
+	previousPhase, known := p.phase[id]
+	p.phase[id] = phase
+	p.status[id] = status
+	p.redrawn[id] = time.Now()
+
+	if !p.terminal {
+		if !known || previousPhase != phase {
+			fmt.Fprintf(p.out, "%s: %s\n", id, status)
+		}
+		return
+	}
+
+	if index < 0 {
+		p.order = append(p.order, id)
+		fmt.Fprintf(p.out, "%s: %s\n", id, status)
+		return
+	}
+
+	linesUp := len(p.order) - index
+	fmt.Fprintf(p.out, "\x1b[%dA\r\x1b[2K%s: %s\x1b[%dB\r", linesUp, id, status, linesUp)
+}
+
+type progressReader struct {
+	io.ReadCloser
+	progress *pullProgress
+	id       string
+	current  int64
+	total    int64
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if n > 0 {
+		r.current += int64(n)
+		r.progress.downloading(r.id, r.current, r.total)
+	}
+	return n, err
+}
+
+func humanSize(size int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1000 && unit < len(units)-1 {
+		value /= 1000
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%dB", size)
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
+
+// humanDuration describes d roughly, the way Docker shows how long ago
+// containers were created or have been up.
+func humanDuration(d time.Duration) string {
+	seconds := int(d.Seconds())
+	minutes := int(d.Minutes())
+	hours := int(d.Round(time.Hour).Hours())
+
+	switch {
+	case seconds < 1:
+		return "Less than a second"
+	case seconds == 1:
+		return "1 second"
+	case seconds < 60:
+		return fmt.Sprintf("%d seconds", seconds)
+	case minutes == 1:
+		return "About a minute"
+	case minutes < 60:
+		return fmt.Sprintf("%d minutes", minutes)
+	case hours == 1:
+		return "About an hour"
+	case hours < 48:
+		return fmt.Sprintf("%d hours", hours)
+	case hours < 24*7*2:
+		return fmt.Sprintf("%d days", hours/24)
+	case hours < 24*30*2:
+		return fmt.Sprintf("%d weeks", hours/24/7)
+	case hours < 24*365*2:
+		return fmt.Sprintf("%d months", hours/24/30)
+	default:
+		return fmt.Sprintf("%d years", hours/24/365)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultRegistry     = "docker.io"
+	defaultTag          = "latest"
+	officialRepoPrefix  = "library/"
+	legacyDefaultDomain = "index.docker.io"
+)
+
+var (
+	pathComponentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*$`)
+	domainRegexp        = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)(?:\.(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?))*(?::[0-9]+)?$|^\[[a-fA-F0-9:]+\](?::[0-9]+)?$`)
+	tagRegexp           = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRegexp        = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+)
+
+// imageReference is a parsed image reference of the form
+// [registry[:port]/]path[:tag][@digest].
+type imageReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// parseReference parses an image reference the same way the docker CLI does:
+// the first path component is only treated as a registry host when it looks
+// like one (contains "." or ":", or is "localhost"), Docker Hub is assumed
+// otherwise, and single-component Docker Hub names live under "library/".
+// A reference without a tag or digest defaults to the "latest" tag.
+func parseReference(image string) (imageReference, error) {
+	var ref imageReference
+
+	if image == "" {
+		return ref, fmt.Errorf("invalid reference format: empty reference")
+	}
+	if strings.ContainsAny(image, " \t\r\n") {
+		return ref, fmt.Errorf("invalid reference format: %q contains whitespace", image)
+	}
+
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		ref.Digest = name[i+1:]
+		name = name[:i]
+		if err := validateDigest(ref.Digest); err != nil {
+			return ref, fmt.Errorf("invalid reference format: %s: %w", image, err)
+		}
+	}
+
+	if i := strings.LastIndex(name, ":"); i >= 0 && !strings.Contains(name[i:], "/") {
+		ref.Tag = name[i+1:]
+		name = name[:i]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return ref, fmt.Errorf("invalid reference format: invalid tag %q", ref.Tag)
+		}
+	}
+
+	ref.Registry, ref.Repository = splitRegistry(name)
+
+	if ref.Registry == legacyDefaultDomain {
+		ref.Registry = defaultRegistry
+	}
+	if !domainRegexp.MatchString(ref.Registry) {
+		return ref, fmt.Errorf("invalid reference format: invalid registry %q", ref.Registry)
+	}
+
+	if ref.Repository == "" {
+		return ref, fmt.Errorf("invalid reference format: missing repository in %q", image)
+	}
+	for _, component := range strings.Split(ref.Repository, "/") {
+		if !pathComponentRegexp.MatchString(component) {
+			if strings.ToLower(component) == component {
+				return ref, fmt.Errorf("invalid reference format: invalid repository path component %q", component)
+			}
+			return ref, fmt.Errorf("invalid reference format: repository name must be lowercase: %s", image)
+		}
+	}
+	if len(ref.Registry)+1+len(ref.Repository) > 255 {
+		return ref, fmt.Errorf("invalid reference format: repository name must not be more than 255 characters")
+	}
+
+	if ref.Registry == defaultRegistry && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = officialRepoPrefix + ref.Repository
+	}
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = defaultTag
+	}
+
+	return ref, nil
+}
+
+func splitRegistry(name string) (string, string) {
+	i := strings.Index(name, "/")
+	if i < 0 {
+		return defaultRegistry, name
+	}
+
+	host := name[:i]
+	if host != "localhost" && !strings.ContainsAny(host, ".:") && strings.ToLower(host) == host {
+		return defaultRegistry, name
+	}
+
+	return host, name[i+1:]
+}
+
+func validateDigest(digest string) error {
+	if !digestRegexp.MatchString(digest) {
+		return fmt.Errorf("invalid digest %q", digest)
+	}
+
+	algorithm, encoded, _ := strings.Cut(digest, ":")
+	switch algorithm {
+	case "sha256":
+		if len(encoded) != 64 || !isLowerHex(encoded) {
+			return fmt.Errorf("invalid sha256 digest %q", digest)
+		}
+	case "sha512":
+		if len(encoded) != 128 || !isLowerHex(encoded) {
+			return fmt.Errorf("invalid sha512 digest %q", digest)
+		}
+	default:
+		return fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+
+	return nil
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Reference returns the manifest reference to request from the registry:
+// the digest when one was given, otherwise the tag.
+func (ref imageReference) Reference() string {
+	if ref.Digest != "" {
+		return ref.Digest
+	}
+	return ref.Tag
+}
+
+// Name returns the fully qualified repository name, e.g.
+// "docker.io/library/alpine".
+func (ref imageReference) Name() string {
+	return ref.Registry + "/" + ref.Repository
+}
+
+// String returns the fully qualified reference, e.g.
+// "docker.io/library/alpine:latest".
+func (ref imageReference) String() string {
+	s := ref.Name()
+	if ref.Tag != "" {
+		s += ":" + ref.Tag
+	}
+	if ref.Digest != "" {
+		s += "@" + ref.Digest
+	}
+	return s
+}
+
+// FamiliarName returns the repository name as the docker CLI displays it,
+// dropping the Docker Hub registry and "library/" prefix.
+func (ref imageReference) FamiliarName() string {
+	if ref.Registry != defaultRegistry {
+		return ref.Name()
+	}
+	return strings.TrimPrefix(ref.Repository, officialRepoPrefix)
+}
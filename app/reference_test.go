@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		image string
+		want  imageReference
+	}{
+		{"alpine", imageReference{Registry: "docker.io", Repository: "library/alpine", Tag: "latest"}},
+		{"alpine:3.19", imageReference{Registry: "docker.io", Repository: "library/alpine", Tag: "3.19"}},
+		{"user/app", imageReference{Registry: "docker.io", Repository: "user/app", Tag: "latest"}},
+		{"docker.io/alpine", imageReference{Registry: "docker.io", Repository: "library/alpine", Tag: "latest"}},
+		{"index.docker.io/library/alpine", imageReference{Registry: "docker.io", Repository: "library/alpine", Tag: "latest"}},
+		{"ghcr.io/owner/app:v1", imageReference{Registry: "ghcr.io", Repository: "owner/app", Tag: "v1"}},
+		{"localhost/app", imageReference{Registry: "localhost", Repository: "app", Tag: "latest"}},
+		{"localhost:5000/app:dev", imageReference{Registry: "localhost:5000", Repository: "app", Tag: "dev"}},
+		{"registry:5000/app", imageReference{Registry: "registry:5000", Repository: "app", Tag: "latest"}},
+		{"registry/app", imageReference{Registry: "docker.io", Repository: "registry/app", Tag: "latest"}},
+		{"[::1]:5000/app", imageReference{Registry: "[::1]:5000", Repository: "app", Tag: "latest"}},
+		{"alpine@" + digest, imageReference{Registry: "docker.io", Repository: "library/alpine", Digest: digest}},
+		{"alpine:3.19@" + digest, imageReference{Registry: "docker.io", Repository: "library/alpine", Tag: "3.19", Digest: digest}},
+		{"quay.io/a/b/c:1.0-rc_1", imageReference{Registry: "quay.io", Repository: "a/b/c", Tag: "1.0-rc_1"}},
+	}
+	for _, test := range tests {
+		ref, err := parseReference(test.image)
+		if err != nil || ref != test.want {
+			t.Errorf("parseReference(%q) = %+v, %v, want %+v", test.image, ref, err, test.want)
+		}
+	}
+}
+
+func TestParseReferenceRejectsInvalidReferences(t *testing.T) {
+	tests := []struct {
+		image string
+		// err is part of the error message.
+		err string
+	}{
+		{"", "empty reference"},
+		{"alpine latest", "contains whitespace"},
+		{"Alpine", "repository name must be lowercase"},
+		{"user/App:latest", "repository name must be lowercase"},
+		{"Registry.io/App", "repository name must be lowercase"},
+		{"alpine:", "invalid tag"},
+		{"alpine:-latest", "invalid tag"},
+		{"alpine@sha256:abc", "invalid sha256 digest"},
+		{"alpine@md5:0123456789abcdef0123456789abcdef", "unsupported digest algorithm"},
+		{"ghcr.io/", "missing repository"},
+		{"user//app", "invalid repository path component"},
+		{"user/-app", "invalid repository path component"},
+		{"-registry.io/app", "invalid registry"},
+		{"user/" + strings.Repeat("a", 255), "must not be more than 255 characters"},
+	}
+	for _, test := range tests {
+		ref, err := parseReference(test.image)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("parseReference(%q) = %+v, %v, want an error containing %q", test.image, ref, err, test.err)
+		}
+	}
+}
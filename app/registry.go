@@ -1,19 +1,27 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
 type AuthToken struct {
+	Token       string `json:"token"`
 	AccessToken string `json:"access_token"`
 	Issued      string `json:"issued_at"`
 	Expires     int    `json:"expires_in"`
+	// Scheme is the Authorization scheme AccessToken is sent with. It is
+	// empty when the registry does not require authentication.
+	Scheme string `json:"-"`
 }
 
 func getHostPlatform() Platform {
@@ -23,16 +31,14 @@ func getHostPlatform() Platform {
 	}
 }
 
-func resolveImageDigest(image string) (string, error) {
-	imageName, imageTag := parseImage(image)
-	authToken, err := requestAuthToken(imageName)
+// resolveImageDigest resolves ref to the manifest of the image for this
+// platform and returns it with the digest of the manifest (or image index) ref
+// points to and the ID of the image.
+func resolveImageDigest(ref imageReference, authToken AuthToken) (interface{}, string, string, error) {
+	platform := getHostPlatform()
+	manifest, digest, err := requestManifest(ref, platform.Os, platform.Architecture, authToken)
 	if err != nil {
-		return "", fmt.Errorf("Error requesting registry auth token: %v\n", err)
-	}
-
-	manifest, err := requestManifest(imageName, imageTag, getHostPlatform().Os, getHostPlatform().Architecture, authToken)
-	if err != nil {
-		return "", fmt.Errorf("Error requesting image manifest: %v\n", err)
+		return nil, "", "", fmt.Errorf("error requesting image manifest: %w", err)
 	}
 
 	switch manifest.(type) {
@@ -41,93 +47,326 @@ func resolveImageDigest(image string) (string, error) {
 		var metadataStruct ImageManifestV1Metadata
 		err = json.Unmarshal([]byte(compatData), &metadataStruct)
 		if err != nil {
-			return "", fmt.Errorf("Error parsing manifest metadata: %v\n", err)
+			return nil, "", "", fmt.Errorf("error parsing manifest metadata: %w", err)
 		}
-		return metadataStruct.ID, nil
+		return manifest, digest, metadataStruct.ID, nil
 	case ImageManifestV2:
-		return manifest.(ImageManifestV2).Config.Digest, nil
+		return manifest, digest, manifest.(ImageManifestV2).Config.Digest, nil
+	}
+
+	return nil, "", "", errors.New("invalid manifest type")
+}
+
+// ensureImage resolves image to its ID, pulling it first when it is not
+// already present locally.
+func ensureImage(image string, progress *pullProgress) (string, error) {
+	ref, err := parseReference(image)
+	if err != nil {
+		return "", err
+	}
+
+	if record, err := findImageByReference(ref); err == nil {
+		return record.Id, nil
 	}
 
-	return "", errors.New("invalid manifest type")
+	progress.message("Unable to find image '%s' locally", image)
+	pulled, err := pullImage(image, progress, defaultMaxConcurrentDownloads)
+	if err != nil {
+		return "", fmt.Errorf("error fetching image: %w", err)
+	}
+
+	return pulled.Id, nil
 }
 
-func pullImage(image string) (string, error) {
-	imageName, imageTag := parseImage(image)
+// pulledImage describes the result of pullImage. Digest is the digest of the
+// manifest (or image index) the reference resolved to.
+type pulledImage struct {
+	Id     string
+	Digest string
+}
 
-	accessToken, err := requestAuthToken(imageName)
+// pullImage downloads image into the store, fetching up to concurrency layers
+// at a time.
+func pullImage(image string, progress *pullProgress, concurrency int) (pulledImage, error) {
+	var pulled pulledImage
+	ref, err := parseReference(image)
 	if err != nil {
-		fmt.Printf("Error requesting registry auth token: %v\n", err)
-		return "", fmt.Errorf("Error requesting registry auth token: %v\n", err)
+		return pulled, err
 	}
 
-	manifest, err := requestManifest(imageName, imageTag, getHostPlatform().Os, getHostPlatform().Architecture, accessToken)
+	accessToken, err := requestAuthToken(ref)
 	if err != nil {
-		fmt.Printf("Error requesting image manifest: %v\n", err)
-		return "", fmt.Errorf("Error requesting image manifest: %v\n", err)
+		return pulled, fmt.Errorf("error requesting registry auth token: %w", err)
 	}
 
-	var imagePath string
+	manifest, digest, imageId, err := resolveImageDigest(ref, accessToken)
+	if err != nil {
+		return pulled, err
+	}
+	pulled.Id = imageId
+	pulled.Digest = digest
+
+	platform := getHostPlatform()
+	record := imageRecord{
+		Os:           platform.Os,
+		Architecture: platform.Architecture,
+		Pulled:       time.Now().UTC(),
+	}
+
+	var config ImageConfig
 	switch manifest.(type) {
-	case ImageManifestV1:
-		_, err = downloadV1ManifestLayers(manifest.(ImageManifestV1), imageName, accessToken)
+	case ImageManifestV2:
+		record.Config = pulled.Id
+		config, err = fetchImageConfig(ref, manifest.(ImageManifestV2).Config, accessToken)
 		if err != nil {
-			fmt.Printf("Error downloading image layers: %v\n", err)
-			return "", fmt.Errorf("Error downloading image layers: %v\n", err)
+			return pulled, fmt.Errorf("error fetching image config: %w", err)
 		}
-		compat := manifest.(ImageManifestV1).History[0].V1Compatibility
-		var metadata ImageManifestV1Metadata
-		err = json.Unmarshal([]byte(compat), &metadata)
-		if err != nil {
-			fmt.Printf("Error parsing manifest metadata: %v\n", err)
-			return "", fmt.Errorf("Error parsing manifest metadata: %v\n", err)
+		record.Created = config.Created
+	}
+	record.Id = pulled.Id
+
+	_, statErr := readImageRecord(pulled.Id)
+	upToDate := statErr == nil
+
+	progress.message("%s: Pulling from %s", ref.Reference(), ref.Repository)
+	removeStaleExtractDirs()
+
+	repoTag := ""
+	if ref.Tag != "" && ref.Digest == "" {
+		repoTag = ref.Name() + ":" + ref.Tag
+	}
+	for attempt := 1; ; attempt++ {
+		switch manifest.(type) {
+		case ImageManifestV1:
+			record.Layers, err = downloadV1ManifestLayers(manifest.(ImageManifestV1), ref, accessToken, progress, concurrency)
+		case ImageManifestV2:
+			record.Layers, err = downloadV2ManifestLayers(manifest.(ImageManifestV2), config.RootFS.DiffIds, ref, accessToken, progress, concurrency)
 		}
-		imagePath = fmt.Sprintf("%s/%s", imageLayerPathPrefix, metadata.ID)
-	case ImageManifestV2:
-		_, err = downloadV2ManifestLayers(manifest.(ImageManifestV2), imageName, accessToken)
 		if err != nil {
-			fmt.Printf("Error downloading image layers: %v\n", err)
-			return "", fmt.Errorf("Error downloading image layers: %v\n", err)
+			return pulled, fmt.Errorf("error downloading image layers: %w", err)
+		}
+
+		err = commitImage(record, repoTag, ref.Name()+"@"+pulled.Digest)
+		// Layers removed by a concurrent rmi are downloaded again.
+		if !errors.Is(err, errLayerRemoved) || attempt == maxDownloadAttempts {
+			break
 		}
-		imagePath = fmt.Sprintf("%s/%s", imageLayerPathPrefix, manifest.(ImageManifestV2).Config.Digest)
+	}
+	if err != nil {
+		return pulled, fmt.Errorf("error storing image: %w", err)
+	}
+
+	progress.message("Digest: %s", pulled.Digest)
+	if upToDate {
+		progress.message("Status: Image is up to date for %s", ref)
+	} else {
+		progress.message("Status: Downloaded newer image for %s", ref)
 	}
 
-	return imagePath, nil
+	return pulled, nil
 }
 
-func parseImage(image string) (string, string) {
-	imageParts := strings.Split(image, ":")
-	if len(imageParts) == 1 {
-		return imageParts[0], "latest"
+// registryBaseUrl returns the API base URL of registry. Docker Hub is served
+// from its own API host and loopback registries are spoken to over plain HTTP,
+// the same as the docker daemon does for local registries.
+func registryBaseUrl(registry string) string {
+	host := registry
+	if host == defaultRegistry {
+		host = defaultRegistryHost
 	}
-	return imageParts[0], imageParts[1]
+
+	if isLoopbackRegistry(host) {
+		return "http://" + host
+	}
+	return "https://" + host
 }
 
-func requestAuthToken(repository string) (AuthToken, error) {
+func isLoopbackRegistry(host string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	hostname = strings.Trim(hostname, "[]")
+
+	if hostname == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(hostname)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requestAuthToken requests a pull token for ref's repository, using the
+// credentials configured for its registry when there are any.
+func requestAuthToken(ref imageReference) (AuthToken, error) {
+	creds, err := lookupCredentials(ref.Registry)
+	if err != nil {
+		return AuthToken{}, err
+	}
+
+	return authenticate(ref.Registry, fmt.Sprintf("repository:%s:pull", ref.Repository), creds)
+}
+
+// authenticate pings the registry API and answers its challenge: Bearer
+// challenges are exchanged for a token with the given scope at the advertised
+// token endpoint, Basic challenges use creds directly. An empty scope requests
+// a token that only proves the credentials.
+func authenticate(registry, scope string, creds registryCredentials) (AuthToken, error) {
 	var token AuthToken
 
-	if !strings.Contains(repository, "library/") {
-		repository = fmt.Sprintf("library/%s", repository)
+	challenges, err := pingRegistry(registry)
+	if err != nil {
+		return token, err
+	}
+
+	if len(challenges) == 0 {
+		return token, nil
+	}
+
+	for _, challenge := range challenges {
+		if strings.EqualFold(challenge.Scheme, "Bearer") {
+			return requestBearerToken(challenge, registry, scope, creds)
+		}
 	}
 
-	tokenResponse, err := http.Get(fmt.Sprintf(authenticationUrl, repository))
+	for _, challenge := range challenges {
+		if strings.EqualFold(challenge.Scheme, "Basic") {
+			if creds.Username == "" {
+				return token, fmt.Errorf("registry %s requires a username and password, run 'mydocker login %s'", registry, registry)
+			}
+			token.Scheme = "Basic"
+			token.AccessToken = base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Password))
+			return token, nil
+		}
+	}
+
+	return token, fmt.Errorf("registry %s requires unsupported authentication scheme %s", registry, challenges[0].Scheme)
+}
+
+// pingRegistry requests the /v2/ endpoint of registry and returns the
+// authentication challenges it answers with, or none if it allows anonymous
+// access.
+func pingRegistry(registry string) ([]authChallenge, error) {
+	response, err := http.Get(fmt.Sprintf(registryPingUrl, registryBaseUrl(registry)))
 	if err != nil {
-		return token, fmt.Errorf("Error requesting auth token: %v\n", err)
+		return nil, fmt.Errorf("error pinging registry %s: %w", registry, err)
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		return nil, nil
+	case http.StatusUnauthorized:
+		challenges := parseAuthChallenges(response.Header.Values("WWW-Authenticate"))
+		if len(challenges) == 0 {
+			return nil, fmt.Errorf("registry %s requires authentication but sent no challenge", registry)
+		}
+		return challenges, nil
+	default:
+		return nil, fmt.Errorf("error pinging registry %s: %s", registry, response.Status)
+	}
+}
+
+func requestBearerToken(challenge authChallenge, registry, scope string, creds registryCredentials) (AuthToken, error) {
+	var token AuthToken
+
+	realm := challenge.Params["realm"]
+	if realm == "" {
+		return token, fmt.Errorf("registry %s sent a Bearer challenge without a realm", registry)
+	}
+
+	tokenUrl, err := url.Parse(realm)
+	if err != nil {
+		return token, fmt.Errorf("invalid token realm %q: %w", realm, err)
+	}
+
+	var req *http.Request
+	if creds.IdentityToken != "" {
+		// Identity tokens are OAuth2 refresh tokens and have to be exchanged
+		// with a POST to the same endpoint.
+		form := url.Values{}
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", creds.IdentityToken)
+		form.Set("client_id", tokenClientId)
+		form.Set("service", challenge.Params["service"])
+		if scope != "" {
+			form.Set("scope", scope)
+		}
+		req, err = http.NewRequest("POST", tokenUrl.String(), strings.NewReader(form.Encode()))
+		if err != nil {
+			return token, fmt.Errorf("error creating token request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		query := tokenUrl.Query()
+		if service := challenge.Params["service"]; service != "" {
+			query.Set("service", service)
+		}
+		if scope != "" {
+			query.Set("scope", scope)
+		}
+		if creds.Username != "" {
+			query.Set("account", creds.Username)
+		}
+		tokenUrl.RawQuery = query.Encode()
+
+		req, err = http.NewRequest("GET", tokenUrl.String(), nil)
+		if err != nil {
+			return token, fmt.Errorf("error creating token request: %w", err)
+		}
+		if creds.Username != "" {
+			req.SetBasicAuth(creds.Username, creds.Password)
+		}
+	}
+
+	tokenResponse, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return token, fmt.Errorf("error requesting auth token: %w", err)
 	}
 	defer tokenResponse.Body.Close()
 
+	if tokenResponse.StatusCode == http.StatusUnauthorized && !creds.isZero() {
+		return token, fmt.Errorf("unauthorized: incorrect username or password for %s", registry)
+	}
 	if tokenResponse.StatusCode != http.StatusOK {
 		return token, fmt.Errorf("error fetching auth token: %s", tokenResponse.Status)
 	}
 
 	err = json.NewDecoder(tokenResponse.Body).Decode(&token)
 	if err != nil {
-		return token, fmt.Errorf("Error decoding auth token: %v\n", err)
+		return token, fmt.Errorf("error decoding auth token: %w", err)
 	}
 
+	// The token spec allows either field and makes issued_at and expires_in
+	// optional.
+	if token.AccessToken == "" {
+		token.AccessToken = token.Token
+	}
+	if token.AccessToken == "" {
+		return token, fmt.Errorf("token endpoint %s returned no token", tokenUrl.Host)
+	}
+	if token.Issued == "" {
+		token.Issued = time.Now().UTC().Format(time.RFC3339)
+	}
+	if token.Expires <= 0 {
+		token.Expires = defaultTokenExpiry
+	}
+	token.Scheme = "Bearer"
+
 	return token, nil
 }
 
+func setAuthorization(req *http.Request, token AuthToken) {
+	if token.Scheme != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("%s %s", token.Scheme, token.AccessToken))
+	}
+}
+
 func isAuthTokenExpired(token AuthToken) bool {
+	// Anonymous access and Basic credentials never expire.
+	if token.Scheme != "Bearer" {
+		return false
+	}
+
 	issuedTime, err := time.Parse(time.RFC3339, token.Issued)
 	if err != nil {
 		return true
@@ -137,8 +376,35 @@ func isAuthTokenExpired(token AuthToken) bool {
 	return time.Now().After(expirationTime)
 }
 
-func refreshAuthToken(image string) (AuthToken, error) {
-	newAuthToken, err := requestAuthToken(image)
+// authTokenSource shares an auth token between concurrent requests and
+// refreshes it once it expires.
+type authTokenSource struct {
+	mu    sync.Mutex
+	ref   imageReference
+	token AuthToken
+}
+
+func newAuthTokenSource(ref imageReference, token AuthToken) *authTokenSource {
+	return &authTokenSource{ref: ref, token: token}
+}
+
+func (s *authTokenSource) get() (AuthToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if isAuthTokenExpired(s.token) {
+		token, err := refreshAuthToken(s.ref)
+		if err != nil {
+			return AuthToken{}, fmt.Errorf("error refreshing auth token: %w", err)
+		}
+		s.token = token
+	}
+
+	return s.token, nil
+}
+
+func refreshAuthToken(ref imageReference) (AuthToken, error) {
+	newAuthToken, err := requestAuthToken(ref)
 	if err != nil {
 		return AuthToken{}, err
 	}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testRegistry is a registry that requires a Bearer token from its own token
+// endpoint, and challenges for Basic credentials besides. It serves
+// test/app:latest and whatever the test adds with handle.
+type testRegistry struct {
+	*httptest.Server
+	mux *http.ServeMux
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	t.Helper()
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json",` +
+		`"config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":2,"digest":"sha256:cafe"},"layers":[]}`
+
+	mux := http.NewServeMux()
+	registry := &testRegistry{Server: httptest.NewServer(mux), mux: mux}
+	t.Cleanup(registry.Close)
+
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			registry.challenge(w)
+		}
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("service") != "test-registry" || query.Get("scope") != "repository:test/app:pull" {
+			http.Error(w, "unexpected token request "+r.URL.RawQuery, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"token":"test-token","expires_in":300}`)
+	})
+	registry.handle("/v2/test/app/manifests/latest", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+		w.Header().Set("Docker-Content-Digest", "sha256:beef")
+		fmt.Fprint(w, manifest)
+	})
+
+	return registry
+}
+
+func (registry *testRegistry) challenge(w http.ResponseWriter) {
+	w.Header().Add("WWW-Authenticate", `Basic realm="test"`)
+	w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test-registry"`, registry.URL))
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+// handle serves pattern with handler to requests carrying the token.
+func (registry *testRegistry) handle(pattern string, handler http.HandlerFunc) {
+	registry.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			registry.challenge(w)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// ref returns the reference to the repository test/app of the registry, with
+// suffix (a tag or digest) appended.
+func (registry *testRegistry) ref(t *testing.T, suffix string) imageReference {
+	t.Helper()
+	ref, err := parseReference(strings.TrimPrefix(registry.URL, "http://") + "/test/app" + suffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+// token authenticates with the registry for pulls from test/app.
+func (registry *testRegistry) token(t *testing.T) AuthToken {
+	t.Helper()
+	t.Setenv("MYDOCKER_CONFIG", t.TempDir())
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	token, err := requestAuthToken(registry.ref(t, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestPullAuthenticatesWithBearerToken(t *testing.T) {
+	registry := newTestRegistry(t)
+
+	token := registry.token(t)
+	if token.Scheme != "Bearer" || token.AccessToken != "test-token" {
+		t.Fatalf("token = %s %q, want Bearer %q", token.Scheme, token.AccessToken, "test-token")
+	}
+
+	manifest, digest, err := requestManifest(registry.ref(t, ""), "linux", "amd64", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != "sha256:beef" {
+		t.Errorf("digest = %s, want sha256:beef", digest)
+	}
+	v2, ok := manifest.(ImageManifestV2)
+	if !ok {
+		t.Fatalf("manifest is a %T, want ImageManifestV2", manifest)
+	}
+	if v2.Config.Digest != "sha256:cafe" {
+		t.Errorf("config digest = %s, want sha256:cafe", v2.Config.Digest)
+	}
+}
+
+func TestPingRegistryReturnsAllChallenges(t *testing.T) {
+	registry := newTestRegistry(t)
+
+	challenges, err := pingRegistry(strings.TrimPrefix(registry.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(challenges) != 2 || challenges[0].Scheme != "Basic" || challenges[1].Scheme != "Bearer" {
+		t.Fatalf("challenges = %+v, want Basic and Bearer", challenges)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Run without root privileges, mydocker re-executes itself in a user
+// namespace, with a mount namespace of its own, in which the invoking user is
+// root and its subordinate IDs from /etc/subuid and /etc/subgid are the other
+// users. The mappings are written by the setuid newuidmap and newgidmap
+// helpers. Pulling images and running containers then happen inside that
+// namespace, without any privileges on the host.
+//
+// rootlessEnv tells the re-executed process where it is: first waiting for
+// its mappings, which it needs to be root in the namespace, then ready.
+const (
+	rootlessEnv          = "_MYDOCKER_ROOTLESS"
+	rootlessStageMapping = "mapping"
+	rootlessStageReady   = "ready"
+	rootlessSyncFd       = 3
+)
+
+// isRootless reports whether mydocker runs without host privileges.
+func isRootless() bool {
+	return os.Getenv(rootlessEnv) != "" || os.Geteuid() != 0
+}
+
+// storageRoot returns the directory of the image and container store:
+// /var/lib/mydocker for root and $XDG_DATA_HOME/mydocker otherwise.
+func storageRoot() string {
+	if !isRootless() {
+		return defaultStoragePath
+	}
+
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			home = "/"
+		}
+		dataHome = path.Join(home, ".local", "share")
+	}
+	return path.Join(dataHome, rootlessStorageDir)
+}
+
+// enterRootlessNamespace moves a rootless mydocker into its user namespace.
+// It returns done and the exit code to use when the current process has
+// nothing left to do, and false when the command should run here.
+//
+// Commands with hostNamespace set stay out of it: acting on the processes of
+// a container takes the privileges the invoking user has over the namespaces
+// of the mydocker running it, which a namespace of its own would not have.
+func enterRootlessNamespace() (int, bool) {
+	switch os.Getenv(rootlessEnv) {
+	case "":
+		if os.Geteuid() == 0 || runsInHostNamespace(os.Args[1:]) {
+			return 0, false
+		}
+		code, err := runInRootlessNamespace()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "mydocker: rootless mode: %s\n", strings.TrimSpace(err.Error()))
+		}
+		return code, true
+	case rootlessStageMapping:
+		err := execWhenMapped()
+		fmt.Fprintf(os.Stderr, "mydocker: rootless mode: %v\n", err)
+		return 1, true
+	default:
+		return 0, false
+	}
+}
+
+func runsInHostNamespace(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	cmd := findCommand(args[0])
+	return cmd != nil && cmd.hostNamespace
+}
+
+// runInRootlessNamespace runs mydocker with the same arguments in a new user
+// namespace and returns its exit code.
+func runInRootlessNamespace() (int, error) {
+	current, err := user.Current()
+	if err != nil {
+		return 1, fmt.Errorf("error looking up current user: %w", err)
+	}
+	uidRange, err := subordinateRange("/etc/subuid", current.Username, current.Uid)
+	if err != nil {
+		return 1, err
+	}
+	gidRange, err := subordinateRange("/etc/subgid", current.Username, current.Uid)
+	if err != nil {
+		return 1, err
+	}
+
+	syncReader, syncWriter, err := os.Pipe()
+	if err != nil {
+		return 1, err
+	}
+	defer syncWriter.Close()
+
+	command := &exec.Cmd{
+		Path:       "/proc/self/exe",
+		Args:       os.Args,
+		Env:        append(os.Environ(), rootlessEnv+"="+rootlessStageMapping),
+		Stdin:      os.Stdin,
+		Stdout:     os.Stdout,
+		Stderr:     os.Stderr,
+		ExtraFiles: []*os.File{syncReader},
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+		},
+	}
+	err = command.Start()
+	_ = syncReader.Close()
+	if err != nil {
+		return 1, fmt.Errorf("error creating user namespace: %w", err)
+	}
+
+	pid := strconv.Itoa(command.Process.Pid)
+	err = writeIdMap("newuidmap", pid, current.Uid, uidRange)
+	if err == nil {
+		err = writeIdMap("newgidmap", pid, current.Gid, gidRange)
+	}
+	if err != nil {
+		_ = command.Process.Kill()
+		_ = command.Wait()
+		return 1, err
+	}
+
+	_ = syncWriter.Close()
+	return waitForExit(command)
+}
+
+// writeIdMap maps root of the namespace of pid to the user's own ID and IDs
+// from 1 on to its subordinate range, using the given setuid helper.
+func writeIdMap(helper, pid, ownId string, subordinate [2]string) error {
+	helperPath, err := exec.LookPath(helper)
+	if err != nil {
+		return fmt.Errorf("%s not found; install the uidmap package: %w", helper, err)
+	}
+
+	output, err := exec.Command(helperPath, pid, "0", ownId, "1", "1", subordinate[0], subordinate[1]).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error running %s: %w: %s", helper, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// subordinateRange returns the start and size of the first range of
+// subordinate IDs of the user in idFile.
+func subordinateRange(idFile, username, uid string) ([2]string, error) {
+	file, err := os.Open(idFile)
+	if err != nil {
+		return [2]string{}, fmt.Errorf("error reading subordinate IDs: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 || (fields[0] != username && fields[0] != uid) {
+			continue
+		}
+		return [2]string{fields[1], fields[2]}, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return [2]string{}, fmt.Errorf("error reading %s: %w", idFile, err)
+	}
+
+	return [2]string{}, fmt.Errorf("no subordinate IDs for %s in %s", username, idFile)
+}
+
+// execWhenMapped waits until the parent has written the ID mappings and then
+// re-executes mydocker, which thereby gains the capabilities of root in the
+// namespace. It only returns on failure.
+func execWhenMapped() error {
+	sync := os.NewFile(rootlessSyncFd, "rootless-sync")
+	_, _ = io.Copy(io.Discard, sync)
+	_ = sync.Close()
+
+	if os.Getuid() != 0 {
+		return fmt.Errorf("user namespace was not mapped")
+	}
+
+	err := os.Setenv(rootlessEnv, rootlessStageReady)
+	if err != nil {
+		return err
+	}
+	return syscall.Exec("/proc/self/exe", os.Args, os.Environ())
+}
@@ -4,75 +4,173 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"syscall"
 )
 
-func sandbox(imageId string) (string, error) {
-	dir, err := createSandboxDir()
+// A sandbox directory holds the root filesystem of one container:
+//
+//	rootfs/      root the command is chrooted into; an overlay mount of the
+//	             image layers or, without overlay support, a copy of them
+//	diff/        changes made to an overlay rootfs
+//	work/        overlay work directory
+//	hostname     generated /etc files, bind mounted into the rootfs
+//	hosts
+//	resolv.conf
+
+// sandbox creates the sandbox of the container containerId with the root
+// filesystem of the image, owned by the container's users as given by ids,
+// and returns its directory.
+func sandbox(containerId, imageId string, ids idMap) (string, error) {
+	dir, err := createSandboxDir(containerId)
 	if err != nil {
 		return "", err
 	}
 
-	err = prepareSandbox(imageId, dir)
+	err = prepareSandbox(imageId, dir, ids)
 	if err != nil {
+		cleanupSandbox(dir)
 		return "", err
 	}
 
 	return dir, nil
 }
 
-func createSandboxDir() (string, error) {
-	sandboxId, err := GenerateRandomSHA256()
+func createSandboxDir(containerId string) (string, error) {
+	sandboxDir := containerSandboxPath(containerId)
+
+	err := os.MkdirAll(sandboxPathPrefix, 0755)
 	if err != nil {
-		return "", fmt.Errorf("error generating random sandbox id: %w", err)
+		return "", fmt.Errorf("error creating sandbox directory: %w", err)
+	}
+	err = os.Mkdir(sandboxDir, 0755)
+	if err != nil {
+		return "", fmt.Errorf("error creating sandbox directory: %w", err)
 	}
 
-	sandboxIdPath := "sha256:" + sandboxId
-	sandboxDir := path.Join(sandboxPathPrefix, sandboxIdPath)
+	return sandboxDir, nil
+}
 
-	if _, err := os.Stat(sandboxDir); !os.IsNotExist(err) {
-		fmt.Printf("sandbox %s does not exist\n", sandboxIdPath)
-		err = os.MkdirAll(sandboxDir, 0755)
-		if err != nil {
-			return "", fmt.Errorf("error creating temp directory: %w", err)
-		}
+// containerSandboxPath returns the sandbox directory of a container, which
+// is named after the container's ID.
+func containerSandboxPath(containerId string) string {
+	return path.Join(sandboxPathPrefix, "sha256:"+containerId)
+}
+
+func sandboxRootFsPath(sandboxDir string) string {
+	return path.Join(sandboxDir, "rootfs")
+}
+
+func prepareSandbox(imageId, sandboxDir string, ids idMap) error {
+	record, err := readImageRecord(imageId)
+	if err != nil {
+		return fmt.Errorf("image %s not found: %w", imageId, err)
 	}
 
-	return sandboxDir, nil
+	err = buildRootFs(record.Layers, sandboxDir, ids)
+	if err != nil {
+		return fmt.Errorf("error assembling root filesystem of image %s: %w", imageId, err)
+	}
+
+	return nil
 }
 
-func prepareSandbox(imageId, sandboxDir string) error {
-	imageLayerPath := path.Join(imageLayerPathPrefix, imageId, "/")
-	if _, err := os.Stat(imageLayerPath); os.IsNotExist(err) {
-		fmt.Printf("image %s layers path not found: %s\n", imageId, imageLayerPath)
-		return fmt.Errorf("image %s layers path not found: %s", imageId, imageLayerPath)
+// buildRootFs assembles the layers, given lowest first as the image config
+// lists them, into the rootfs of the sandbox, so that files from upper layers
+// override and delete those of lower ones. When container IDs map to other
+// host IDs the layers are copied with their ownership shifted accordingly.
+func buildRootFs(layers []string, sandboxDir string, ids idMap) error {
+	for _, diffId := range layers {
+		if !layerExists(diffId) {
+			return fmt.Errorf("layer %s not found: %s", diffId, layerPath(diffId))
+		}
 	}
 
-	layerIds, err := os.ReadDir(imageLayerPath)
+	// Copying every layer is the fallback for when overlay is unavailable,
+	// e.g. when the store itself lives on an overlay filesystem.
+	if !ids.shifted() && mountOverlayRootFs(layers, sandboxDir) == nil {
+		return nil
+	}
+
+	return copyRootFs(layers, sandboxDir, ids)
+}
+
+// copyRootFs copies the layers, given lowest first, one over the other into
+// sandboxDir/rootfs.
+func copyRootFs(layers []string, sandboxDir string, ids idMap) error {
+	rootFsPath := sandboxRootFsPath(sandboxDir)
+	err := os.MkdirAll(rootFsPath, 0755)
 	if err != nil {
-		return fmt.Errorf("error reading image %s layer(s) path: %w", imageId, err)
+		return fmt.Errorf("error creating directory: %w", err)
 	}
 
-	for _, layerId := range layerIds {
-		layerIdPath := path.Join(imageLayerPath, layerId.Name(), "/")
+	for _, diffId := range layers {
+		err = copyDir(layerRootFsPath(diffId), rootFsPath, ids)
+		if err != nil {
+			return fmt.Errorf("error copying layer %s: %w", diffId, err)
+		}
+	}
+
+	return nil
+}
+
+// mountOverlayRootFs mounts the layers, given lowest first, as an overlay on
+// sandboxDir/rootfs. The layers stay read-only and shared with every other
+// sandbox; changes are written to the sandbox's own diff directory.
+func mountOverlayRootFs(layers []string, sandboxDir string) error {
+	// Overlay lists the topmost lower directory first. A layer that occurs
+	// more than once only matters in its topmost position.
+	var lowerDirs []string
+	for i := len(layers) - 1; i >= 0; i-- {
+		lowerDirs = appendUnique(lowerDirs, layerRootFsPath(layers[i]))
+	}
+
+	rootFsPath := sandboxRootFsPath(sandboxDir)
+	upperPath := path.Join(sandboxDir, "diff")
+	workPath := path.Join(sandboxDir, "work")
+
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowerDirs, ":"), upperPath, workPath)
+	if isRootless() {
+		options += ",userxattr"
+	}
+	if len(options) >= os.Getpagesize() {
+		return fmt.Errorf("too many layers for an overlay mount: %d", len(lowerDirs))
+	}
 
-		err = copyDir(layerIdPath, sandboxDir)
+	for _, dir := range []string{rootFsPath, upperPath, workPath} {
+		err := os.MkdirAll(dir, 0755)
 		if err != nil {
-			errorMessage := fmt.Sprintf("Error copying image %s layer(s) to sandbox: %v", imageId, err)
-			fmt.Println(errorMessage)
-			return fmt.Errorf(errorMessage)
+			return fmt.Errorf("error creating directory: %w", err)
 		}
 	}
 
+	err := syscall.Mount("overlay", rootFsPath, "overlay", 0, options)
+	if err != nil {
+		_ = os.RemoveAll(upperPath)
+		_ = os.RemoveAll(workPath)
+		return fmt.Errorf("error mounting overlay: %w", err)
+	}
+
 	return nil
 }
 
-func copyDir(src string, dst string) error {
+// copyDir copies the tree at src over dst. Whiteouts in src delete the entry
+// they stand for from dst and opaque directories replace their counterpart in
+// dst instead of merging with it, so copying layers in order yields the same
+// tree an overlay mount of them would. Owners are translated to host IDs
+// with ids.
+func copyDir(src string, dst string, ids idMap) error {
 	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
 		relativePath, err := filepath.Rel(src, path)
 		if err != nil {
 			return err
@@ -80,18 +178,74 @@ func copyDir(src string, dst string) error {
 
 		destPath := filepath.Join(dst, relativePath)
 
-		if info.Mode()&os.ModeSymlink != 0 {
-			return copySymLink(path, destPath)
+		if isWhiteout(info) {
+			return os.RemoveAll(destPath)
 		}
 
 		if info.IsDir() {
-			return os.MkdirAll(destPath, info.Mode())
+			if relativePath != "." && isOpaqueDir(path) {
+				err = os.RemoveAll(destPath)
+			} else {
+				err = removeExisting(destPath, true)
+			}
+			if err != nil {
+				return err
+			}
+			err = os.MkdirAll(destPath, info.Mode())
+			if err != nil {
+				return err
+			}
+			return copyOwnership(info, destPath, ids)
+		}
+
+		err = removeExisting(destPath, false)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			err = copySymLink(path, destPath)
+		case info.Mode().IsRegular():
+			err = copyFile(path, destPath)
+		default:
+			err = copySpecialFile(info, destPath)
+		}
+		if err != nil {
+			return err
 		}
 
-		return copyFile(path, destPath)
+		return copyOwnership(info, destPath, ids)
 	})
 }
 
+// copySpecialFile recreates a device node or named pipe.
+func copySpecialFile(info os.FileInfo, dest string) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("error copying %s: unsupported file type", info.Name())
+	}
+	return syscall.Mknod(dest, stat.Mode, int(stat.Rdev))
+}
+
+// copyOwnership gives dest the owner, translated with ids, and mode of the
+// file described by info. Only root can change the owner; for anyone else the
+// copy keeps their own. The mode is set afterwards, as changing the owner
+// clears setuid bits.
+func copyOwnership(info os.FileInfo, dest string, ids idMap) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if ok && os.Geteuid() == 0 {
+		err := os.Lchown(dest, ids.hostUid(int(stat.Uid)), ids.hostGid(int(stat.Gid)))
+		if err != nil {
+			return err
+		}
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return os.Chmod(dest, info.Mode())
+}
+
 func copySymLink(source, dest string) error {
 	linkDest, err := os.Readlink(source)
 	if err != nil {
@@ -103,33 +257,50 @@ func copySymLink(source, dest string) error {
 func copyFile(source, dest string) error {
 	sourceFile, err := os.Open(source)
 	if err != nil {
-		return fmt.Errorf("Error opening source file: %v\n", err)
+		return fmt.Errorf("error opening source file: %w", err)
 	}
 	defer sourceFile.Close()
 
 	destFile, err := os.Create(dest)
 	if err != nil {
-		return fmt.Errorf("Error creating destination file: %v\n", err)
+		return fmt.Errorf("error creating destination file: %w", err)
 	}
 	defer destFile.Close()
 
 	_, err = io.Copy(destFile, sourceFile)
 	if err != nil {
-		return fmt.Errorf("Error copying file: %v\n", err)
+		return fmt.Errorf("error copying file: %w", err)
 	}
 
 	sourceInfo, err := os.Stat(source)
 	if err != nil {
-		return fmt.Errorf("Error getting source file info: %v\n", err)
+		return fmt.Errorf("error getting source file info: %w", err)
 	}
 
 	return os.Chmod(dest, sourceInfo.Mode())
 }
 
+// cleanupSandbox unmounts the sandbox rootfs, if it is an overlay, and
+// removes the sandbox.
 func cleanupSandbox(sandboxDir string) {
+	if unmountSandbox(sandboxDir) != nil {
+		return
+	}
+
 	_ = os.RemoveAll(sandboxDir)
 }
 
+// unmountSandbox unmounts the sandbox rootfs if it is an overlay, leaving
+// the changes made to it in place.
+func unmountSandbox(sandboxDir string) error {
+	err := syscall.Unmount(sandboxRootFsPath(sandboxDir), syscall.MNT_DETACH)
+	if err != nil && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.ENOENT) {
+		fmt.Fprintf(os.Stderr, "error unmounting sandbox %s: %v\n", sandboxDir, err)
+		return err
+	}
+	return nil
+}
+
 func GenerateRandomSHA256() (string, error) {
 	randomBytes := make([]byte, 32)
 	_, err := rand.Read(randomBytes)
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// writeTestLayer stores a layer whose rootfs holds files, mapping paths to
+// contents, and returns the layer's rootfs directory.
+func writeTestLayer(t *testing.T, diffId string, files map[string]string) string {
+	t.Helper()
+
+	err := writeLayerRecord(layerRecord{DiffId: diffId, RefCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootFs := layerRootFsPath(diffId)
+	err = os.MkdirAll(rootFs, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		filePath := filepath.Join(rootFs, name)
+		err = os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err == nil {
+			err = os.WriteFile(filePath, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rootFs
+}
+
+// makeWhiteout marks name in the layer rootfs as deleted the way extracted
+// layers do, with a 0/0 character device.
+func makeWhiteout(t *testing.T, rootFs, name string) {
+	t.Helper()
+	err := syscall.Mknod(filepath.Join(rootFs, name), syscall.S_IFCHR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyRootFsUpperLayerWins(t *testing.T) {
+	useTempStore(t)
+	writeTestLayer(t, "sha256:1111", map[string]string{"etc/config": "base", "etc/base-only": "base", "bin/tool": "base"})
+	writeTestLayer(t, "sha256:2222", map[string]string{"etc/config": "middle", "bin/tool": "middle"})
+	writeTestLayer(t, "sha256:3333", map[string]string{"etc/config": "top"})
+
+	sandboxDir := t.TempDir()
+	err := copyRootFs([]string{"sha256:1111", "sha256:2222", "sha256:3333"}, sandboxDir, idMap{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootFs := sandboxRootFsPath(sandboxDir)
+	assertFileContent(t, filepath.Join(rootFs, "etc/config"), "top")
+	assertFileContent(t, filepath.Join(rootFs, "bin/tool"), "middle")
+	assertFileContent(t, filepath.Join(rootFs, "etc/base-only"), "base")
+}
+
+func TestPrepareSandboxAppliesLayersInRecordOrder(t *testing.T) {
+	useTempStore(t)
+	// The lowest layer sorts last by name, so applying layers in directory
+	// order would let it win.
+	writeTestLayer(t, "sha256:ffff", map[string]string{"file": "lower"})
+	writeTestLayer(t, "sha256:0000", map[string]string{"file": "upper"})
+	err := writeImageRecord(imageRecord{Id: "sha256:abcd", Layers: []string{"sha256:ffff", "sha256:0000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Shifted IDs make the sandbox take the copy path instead of overlay.
+	ids := idMap{
+		Uids: []syscall.SysProcIDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		Gids: []syscall.SysProcIDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+	}
+	sandboxDir := t.TempDir()
+	err = prepareSandbox("sha256:abcd", sandboxDir, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertFileContent(t, filepath.Join(sandboxRootFsPath(sandboxDir), "file"), "upper")
+}
+
+func TestCopyRootFsWhiteoutDeletesLowerFile(t *testing.T) {
+	requireRoot(t)
+	useTempStore(t)
+	writeTestLayer(t, "sha256:1111", map[string]string{"etc/deleted": "base", "etc/kept": "base", "olddir/file": "base"})
+	upper := writeTestLayer(t, "sha256:2222", map[string]string{"etc/new": "upper"})
+	makeWhiteout(t, upper, "etc/deleted")
+	makeWhiteout(t, upper, "olddir")
+
+	sandboxDir := t.TempDir()
+	err := copyRootFs([]string{"sha256:1111", "sha256:2222"}, sandboxDir, idMap{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootFs := sandboxRootFsPath(sandboxDir)
+	assertNotExist(t, filepath.Join(rootFs, "etc/deleted"))
+	assertNotExist(t, filepath.Join(rootFs, "olddir"))
+	assertFileContent(t, filepath.Join(rootFs, "etc/kept"), "base")
+	assertFileContent(t, filepath.Join(rootFs, "etc/new"), "upper")
+}
+
+func TestCopyRootFsOpaqueDirHidesLowerContents(t *testing.T) {
+	useTempStore(t)
+	writeTestLayer(t, "sha256:1111", map[string]string{"data/old": "base", "other/file": "base"})
+	upper := writeTestLayer(t, "sha256:2222", map[string]string{"data/new": "upper"})
+	err := lsetxattr(filepath.Join(upper, "data"), overlayOpaqueXattr(), []byte("y"))
+	if err != nil {
+		t.Skipf("cannot set %s: %v", overlayOpaqueXattr(), err)
+	}
+
+	sandboxDir := t.TempDir()
+	err = copyRootFs([]string{"sha256:1111", "sha256:2222"}, sandboxDir, idMap{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootFs := sandboxRootFsPath(sandboxDir)
+	assertNotExist(t, filepath.Join(rootFs, "data/old"))
+	assertFileContent(t, filepath.Join(rootFs, "data/new"), "upper")
+	assertFileContent(t, filepath.Join(rootFs, "other/file"), "base")
+}
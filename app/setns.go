@@ -0,0 +1,9 @@
+//go:build !386 && !amd64
+
+package main
+
+import "syscall"
+
+// sysSetns is the number of the setns system call. The syscall package lacks
+// it on 386 and amd64, whose numbers are in setns_386.go and setns_amd64.go.
+const sysSetns = syscall.SYS_SETNS
@@ -0,0 +1,4 @@
+package main
+
+// sysSetns is the number of the setns system call on 386.
+const sysSetns = 346
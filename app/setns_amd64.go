@@ -0,0 +1,4 @@
+package main
+
+// sysSetns is the number of the setns system call on amd64.
+const sysSetns = 308
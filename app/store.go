@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The store keeps every piece of content once, keyed by its digest:
+//
+//	blobs/sha256/<hex>                        image config blobs
+//	ingest/sha256/<hex>                       partially downloaded blobs
+//	layers/sha256/<hex>/rootfs                extracted layer, keyed by diff-ID
+//	layers/sha256/<hex>/layer.json            layerRecord
+//	layers/.extract-*                         layers being extracted
+//	distribution/diffid-by-digest/sha256/<hex> diff-ID of a compressed blob
+//	images/<image id>.json                    imageRecord
+//
+// Layers are shared between images and reference counted by the image
+// records that list them. Blobs are downloaded into ingest, so that a download
+// interrupted along with mydocker resumes where it stopped the next time. Layer
+// blobs are extracted as they arrive and removed from ingest once extracted;
+// only config blobs are moved into blobs.
+
+type layerRecord struct {
+	DiffId string `json:"diffId"`
+	// Digest is the compressed blob the layer was extracted from.
+	Digest   string `json:"digest"`
+	Size     int64  `json:"size"`
+	RefCount int    `json:"refCount"`
+}
+
+type imageRecord struct {
+	Id          string   `json:"id"`
+	RepoTags    []string `json:"repoTags"`
+	RepoDigests []string `json:"repoDigests"`
+	// Config is the digest of the image config blob; empty for images pulled
+	// from schema 1 manifests, which have none.
+	Config string `json:"config,omitempty"`
+	// Layers are the diff-IDs of the image layers, lowest layer first.
+	Layers       []string  `json:"layers"`
+	Os           string    `json:"os"`
+	Architecture string    `json:"architecture"`
+	Created      time.Time `json:"created"`
+	Pulled       time.Time `json:"pulled"`
+}
+
+func digestPath(prefix, digest string) string {
+	algorithm, encoded, found := strings.Cut(digest, ":")
+	if !found {
+		return path.Join(prefix, digest)
+	}
+	return path.Join(prefix, algorithm, encoded)
+}
+
+func blobPath(digest string) string {
+	return digestPath(blobPathPrefix, digest)
+}
+
+func layerPath(diffId string) string {
+	return digestPath(layerPathPrefix, diffId)
+}
+
+func layerRootFsPath(diffId string) string {
+	return path.Join(layerPath(diffId), "rootfs")
+}
+
+func imageRecordPath(imageId string) string {
+	return path.Join(imagePathPrefix, imageId+".json")
+}
+
+func blobExists(digest string) bool {
+	_, err := os.Stat(blobPath(digest))
+	return err == nil
+}
+
+// layerExists reports whether the layer has been completely extracted. The
+// layer directory is only renamed into place once extraction has finished.
+func layerExists(diffId string) bool {
+	_, err := os.Stat(path.Join(layerPath(diffId), "layer.json"))
+	return err == nil
+}
+
+// lockStore takes an exclusive lock on the store for updates of reference
+// counts and image records. The returned function releases it.
+func lockStore() (func(), error) {
+	err := os.MkdirAll(storagePathPrefix, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating storage directory: %w", err)
+	}
+
+	file, err := os.OpenFile(storeLockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening store lock: %w", err)
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("error locking store: %w", err)
+	}
+
+	return func() {
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		_ = file.Close()
+	}, nil
+}
+
+func readJSONFile(filePath string, v interface{}) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error parsing %s: %w", filePath, err)
+	}
+	return nil
+}
+
+// writeJSONFile atomically replaces filePath with the JSON encoding of v.
+func writeJSONFile(filePath string, v interface{}) error {
+	err := os.MkdirAll(path.Dir(filePath), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %w", filePath, err)
+	}
+
+	tempPath := filePath + ".tmp"
+	err = os.WriteFile(tempPath, append(data, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", tempPath, err)
+	}
+
+	return os.Rename(tempPath, filePath)
+}
+
+func readLayerRecord(diffId string) (layerRecord, error) {
+	var record layerRecord
+	err := readJSONFile(path.Join(layerPath(diffId), "layer.json"), &record)
+	return record, err
+}
+
+func writeLayerRecord(record layerRecord) error {
+	return writeJSONFile(path.Join(layerPath(record.DiffId), "layer.json"), record)
+}
+
+// lookupDiffId returns the diff-ID of the layer previously extracted from the
+// compressed blob with the given digest.
+func lookupDiffId(digest string) (string, bool) {
+	data, err := os.ReadFile(digestPath(diffIdPathPrefix, digest))
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(data)), true
+}
+
+func recordDiffId(digest, diffId string) error {
+	filePath := digestPath(diffIdPathPrefix, digest)
+	err := os.MkdirAll(path.Dir(filePath), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating directory: %w", err)
+	}
+	return os.WriteFile(filePath, []byte(diffId+"\n"), 0644)
+}
+
+func readImageRecord(imageId string) (imageRecord, error) {
+	var record imageRecord
+	err := readJSONFile(imageRecordPath(imageId), &record)
+	return record, err
+}
+
+// readImageConfig returns the config of an image. Images pulled from schema 1
+// manifests have none, and get an empty one.
+func readImageConfig(imageId string) (ImageConfig, error) {
+	var config ImageConfig
+	record, err := readImageRecord(imageId)
+	if err != nil || record.Config == "" {
+		return config, err
+	}
+	err = readJSONFile(blobPath(record.Config), &config)
+	return config, err
+}
+
+func writeImageRecord(record imageRecord) error {
+	return writeJSONFile(imageRecordPath(record.Id), record)
+}
+
+// listImageRecords returns all image records, most recently pulled first.
+func listImageRecords() ([]imageRecord, error) {
+	entries, err := os.ReadDir(imagePathPrefix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading images path: %w", err)
+	}
+
+	var records []imageRecord
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		record, err := readImageRecord(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			return nil, fmt.Errorf("error reading image record %s: %w", entry.Name(), err)
+		}
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Pulled.After(records[j].Pulled)
+	})
+
+	return records, nil
+}
+
+// errLayerRemoved is returned by commitImage when a layer of the image is no
+// longer in the store.
+var errLayerRemoved = errors.New("layer was removed")
+
+// commitImage stores record and points repoTag and repoDigest at it. The
+// layers of a new image gain a reference; a tag that pointed at another image
+// is moved. A pull checks whether layers are in the store without the store
+// lock, so a layer found there may have been removed with the last image
+// referencing it since; commitImage then fails with errLayerRemoved.
+func commitImage(record imageRecord, repoTag, repoDigest string) error {
+	unlock, err := lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	existing, err := readImageRecord(record.Id)
+	switch {
+	case err == nil:
+		record.RepoTags = existing.RepoTags
+		record.RepoDigests = existing.RepoDigests
+	case errors.Is(err, os.ErrNotExist):
+		for _, diffId := range uniqueStrings(record.Layers) {
+			if !layerExists(diffId) {
+				return fmt.Errorf("error storing image %s: layer %s: %w", record.Id, diffId, errLayerRemoved)
+			}
+		}
+		for _, diffId := range uniqueStrings(record.Layers) {
+			if err := adjustLayerRefCount(diffId, 1); err != nil {
+				return err
+			}
+		}
+	default:
+		return err
+	}
+
+	if repoTag != "" {
+		if err := untagOthers(record.Id, repoTag); err != nil {
+			return err
+		}
+		record.RepoTags = appendUnique(record.RepoTags, repoTag)
+	}
+	if repoDigest != "" {
+		record.RepoDigests = appendUnique(record.RepoDigests, repoDigest)
+	}
+
+	return writeImageRecord(record)
+}
+
+func untagOthers(imageId, repoTag string) error {
+	records, err := listImageRecords()
+	if err != nil {
+		return err
+	}
+
+	for _, other := range records {
+		if other.Id == imageId || !containsString(other.RepoTags, repoTag) {
+			continue
+		}
+		other.RepoTags = removeString(other.RepoTags, repoTag)
+		if err := writeImageRecord(other); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// untagImage removes repoTag from the image, deleting the image when it was
+// its last tag. It reports whether the image was deleted.
+func untagImage(imageId, repoTag string) (bool, error) {
+	unlock, err := lockStore()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	record, err := readImageRecord(imageId)
+	if err != nil {
+		return false, err
+	}
+
+	record.RepoTags = removeString(record.RepoTags, repoTag)
+	if len(record.RepoTags) > 0 {
+		return false, writeImageRecord(record)
+	}
+
+	return true, removeImageRecord(record)
+}
+
+// deleteImage removes the image record and drops its layer references,
+// deleting layers and blobs that are no longer referenced by any image.
+func deleteImage(imageId string) error {
+	unlock, err := lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	record, err := readImageRecord(imageId)
+	if err != nil {
+		return err
+	}
+
+	return removeImageRecord(record)
+}
+
+// removeImageRecord drops the layer references of an image and then its
+// record. Should dropping a reference fail, the record is left listing the
+// layers it still references, so that removing the image again does not drop
+// any reference twice. The store lock must be held.
+func removeImageRecord(record imageRecord) error {
+	layers := uniqueStrings(record.Layers)
+	for i, diffId := range layers {
+		if err := adjustLayerRefCount(diffId, -1); err != nil {
+			record.Layers = layers[i:]
+			_ = writeImageRecord(record)
+			return err
+		}
+	}
+
+	err := os.Remove(imageRecordPath(record.Id))
+	if err != nil {
+		return fmt.Errorf("error removing image %s: %w", record.Id, err)
+	}
+
+	if record.Config != "" {
+		_ = os.Remove(blobPath(record.Config))
+	}
+
+	return nil
+}
+
+// adjustLayerRefCount changes the reference count of a layer by delta and
+// removes the layer together with its blob once nothing references it. The
+// store lock must be held.
+func adjustLayerRefCount(diffId string, delta int) error {
+	record, err := readLayerRecord(diffId)
+	if err != nil {
+		return fmt.Errorf("error reading layer %s: %w", diffId, err)
+	}
+
+	record.RefCount += delta
+	if record.RefCount > 0 {
+		return writeLayerRecord(record)
+	}
+
+	err = os.RemoveAll(layerPath(diffId))
+	if err != nil {
+		return fmt.Errorf("error removing layer %s: %w", diffId, err)
+	}
+	if record.Digest != "" {
+		_ = os.Remove(blobPath(record.Digest))
+		_ = os.Remove(digestPath(diffIdPathPrefix, record.Digest))
+	}
+
+	return nil
+}
+
+func appendUnique(values []string, value string) []string {
+	if containsString(values, value) {
+		return values
+	}
+	return append(values, value)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(values []string, value string) []string {
+	var result []string
+	for _, v := range values {
+		if v != value {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func uniqueStrings(values []string) []string {
+	var result []string
+	for _, v := range values {
+		result = appendUnique(result, v)
+	}
+	return result
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTempStore points the store at a temporary directory for the duration of
+// the test.
+func useTempStore(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+
+	saved := []*string{&storagePathPrefix, &blobPathPrefix, &layerPathPrefix, &imagePathPrefix, &diffIdPathPrefix, &storeLockPath, &ingestPathPrefix}
+	values := make([]string, len(saved))
+	for i, prefix := range saved {
+		values[i] = *prefix
+	}
+	t.Cleanup(func() {
+		for i, prefix := range saved {
+			*prefix = values[i]
+		}
+	})
+
+	storagePathPrefix = dir
+	blobPathPrefix = filepath.Join(dir, "blobs")
+	layerPathPrefix = filepath.Join(dir, "layers")
+	imagePathPrefix = filepath.Join(dir, "images")
+	diffIdPathPrefix = filepath.Join(dir, "distribution/diffid-by-digest")
+	storeLockPath = filepath.Join(dir, "lock")
+	ingestPathPrefix = filepath.Join(dir, "ingest")
+}
+
+// storeTestLayer stores an extracted layer that no image references yet, the
+// way a pull leaves it before committing the image, along with its blob.
+func storeTestLayer(t *testing.T, diffId, digest string) {
+	t.Helper()
+	err := os.MkdirAll(layerRootFsPath(diffId), 0755)
+	if err == nil {
+		err = writeLayerRecord(layerRecord{DiffId: diffId, Digest: digest})
+	}
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(blobPath(digest)), 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(blobPath(digest), nil, 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertRefCount(t *testing.T, diffId string, want int) {
+	t.Helper()
+	record, err := readLayerRecord(diffId)
+	if err != nil {
+		t.Fatalf("reading layer %s: %v", diffId, err)
+	}
+	if record.RefCount != want {
+		t.Errorf("layer %s has %d references, want %d", diffId, record.RefCount, want)
+	}
+}
+
+func assertLayerRemoved(t *testing.T, diffId, digest string) {
+	t.Helper()
+	if layerExists(diffId) {
+		t.Errorf("layer %s exists, want it removed", diffId)
+	}
+	if blobExists(digest) {
+		t.Errorf("blob %s exists, want it removed", digest)
+	}
+}
+
+func TestCommitImageCountsLayerReferences(t *testing.T) {
+	useTempStore(t)
+	storeTestLayer(t, "sha256:aaaa", "sha256:0a0a")
+	storeTestLayer(t, "sha256:bbbb", "sha256:0b0b")
+	storeTestLayer(t, "sha256:cccc", "sha256:0c0c")
+
+	err := commitImage(imageRecord{Id: "sha256:1111", Layers: []string{"sha256:aaaa", "sha256:bbbb"}}, "docker.io/test/one:latest", "")
+	if err == nil {
+		err = commitImage(imageRecord{Id: "sha256:2222", Layers: []string{"sha256:aaaa", "sha256:cccc", "sha256:aaaa"}}, "docker.io/test/two:latest", "")
+	}
+	// Pulling an image that is already there adds no references.
+	if err == nil {
+		err = commitImage(imageRecord{Id: "sha256:1111", Layers: []string{"sha256:aaaa", "sha256:bbbb"}}, "docker.io/test/one:v1", "docker.io/test/one@sha256:9999")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertRefCount(t, "sha256:aaaa", 2)
+	assertRefCount(t, "sha256:bbbb", 1)
+	assertRefCount(t, "sha256:cccc", 1)
+
+	record, err := readImageRecord("sha256:1111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record.RepoTags) != 2 || len(record.RepoDigests) != 1 {
+		t.Errorf("image has tags %v and digests %v, want two tags and one digest", record.RepoTags, record.RepoDigests)
+	}
+}
+
+func TestCommitImageMovesTag(t *testing.T) {
+	useTempStore(t)
+
+	err := commitImage(imageRecord{Id: "sha256:1111"}, "docker.io/test/app:latest", "")
+	if err == nil {
+		err = commitImage(imageRecord{Id: "sha256:2222"}, "docker.io/test/app:latest", "")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := readImageRecord("sha256:1111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(old.RepoTags) != 0 {
+		t.Errorf("old image has tags %v, want none", old.RepoTags)
+	}
+	ref, err := parseReference("docker.io/test/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := findImageByReference(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Id != "sha256:2222" {
+		t.Errorf("docker.io/test/app:latest is %s, want sha256:2222", current.Id)
+	}
+}
+
+func TestCommitImageFailsForRemovedLayer(t *testing.T) {
+	useTempStore(t)
+	storeTestLayer(t, "sha256:aaaa", "sha256:0a0a")
+
+	err := commitImage(imageRecord{Id: "sha256:1111", Layers: []string{"sha256:aaaa", "sha256:bbbb"}}, "docker.io/test/app:latest", "")
+	if !errors.Is(err, errLayerRemoved) {
+		t.Fatalf("err = %v, want errLayerRemoved", err)
+	}
+
+	assertRefCount(t, "sha256:aaaa", 0)
+	if _, err := readImageRecord("sha256:1111"); !os.IsNotExist(err) {
+		t.Errorf("image record exists (err = %v), want none", err)
+	}
+}
+
+func TestDeleteImageRemovesUnreferencedLayers(t *testing.T) {
+	useTempStore(t)
+	storeTestLayer(t, "sha256:aaaa", "sha256:0a0a")
+	storeTestLayer(t, "sha256:bbbb", "sha256:0b0b")
+	err := commitImage(imageRecord{Id: "sha256:1111", Layers: []string{"sha256:aaaa", "sha256:bbbb"}}, "docker.io/test/one:latest", "")
+	if err == nil {
+		err = commitImage(imageRecord{Id: "sha256:2222", Layers: []string{"sha256:aaaa"}}, "docker.io/test/two:latest", "")
+	}
+	if err == nil {
+		err = deleteImage("sha256:1111")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertRefCount(t, "sha256:aaaa", 1)
+	assertLayerRemoved(t, "sha256:bbbb", "sha256:0b0b")
+	if _, err := readImageRecord("sha256:1111"); !os.IsNotExist(err) {
+		t.Errorf("image record exists (err = %v), want it removed", err)
+	}
+
+	err = deleteImage("sha256:2222")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLayerRemoved(t, "sha256:aaaa", "sha256:0a0a")
+}
+
+func TestDeleteImageKeepsReferencesItFailedToDrop(t *testing.T) {
+	useTempStore(t)
+	storeTestLayer(t, "sha256:aaaa", "sha256:0a0a")
+	storeTestLayer(t, "sha256:bbbb", "sha256:0b0b")
+	err := commitImage(imageRecord{Id: "sha256:1111", Layers: []string{"sha256:aaaa", "sha256:bbbb"}}, "docker.io/test/app:latest", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layerJson := filepath.Join(layerPath("sha256:bbbb"), "layer.json")
+	err = os.WriteFile(layerJson, []byte("{"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteImage("sha256:1111"); err == nil {
+		t.Fatal("deleteImage succeeded with a corrupt layer record")
+	}
+
+	assertLayerRemoved(t, "sha256:aaaa", "sha256:0a0a")
+	record, err := readImageRecord("sha256:1111")
+	if err != nil {
+		t.Fatalf("image record is gone (err = %v), want it kept", err)
+	}
+	if len(record.Layers) != 1 || record.Layers[0] != "sha256:bbbb" {
+		t.Errorf("image record lists layers %v, want only the one still referenced", record.Layers)
+	}
+}
+
+func TestUntagImageDeletesImageWithItsLastTag(t *testing.T) {
+	useTempStore(t)
+	storeTestLayer(t, "sha256:aaaa", "sha256:0a0a")
+	err := commitImage(imageRecord{Id: "sha256:1111", Layers: []string{"sha256:aaaa"}}, "docker.io/test/app:latest", "")
+	if err == nil {
+		err = commitImage(imageRecord{Id: "sha256:1111", Layers: []string{"sha256:aaaa"}}, "docker.io/test/app:v1", "")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := untagImage("sha256:1111", "docker.io/test/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted {
+		t.Fatal("image deleted while it still has a tag")
+	}
+	assertRefCount(t, "sha256:aaaa", 1)
+
+	deleted, err = untagImage("sha256:1111", "docker.io/test/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deleted {
+		t.Fatal("image kept after removing its last tag")
+	}
+	assertLayerRemoved(t, "sha256:aaaa", "sha256:0a0a")
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// supervisorArg is the argv[0] under which mydocker re-executes itself to
+// run a detached container. The supervisor runs in a session of its own,
+// with the container's log for output, and does for the container what
+// mydocker run does in the foreground, recording its exit when it is done.
+const supervisorArg = "mydocker-supervisor"
+
+// The supervisor receives its supervisorSpec on the first extra file and
+// reports on the second once the container is running or has failed to
+// start.
+const (
+	supervisorSpecFd  = 3
+	supervisorReplyFd = 4
+)
+
+// supervisorSpec describes the container a supervisor runs.
+type supervisorSpec struct {
+	State   containerState `json:"state"`
+	Args    []string       `json:"args"`
+	Options runOptions     `json:"options"`
+}
+
+// supervisorReply is what the supervisor sends back once it is done starting
+// the container. An empty Error means it is running.
+type supervisorReply struct {
+	Error    string `json:"error,omitempty"`
+	ExitCode int    `json:"exitCode"`
+}
+
+// runDetached runs a container in the background under a supervisor and
+// returns once it is running. Its output goes to its log.
+func runDetached(state containerState, args []string, options runOptions) (int, error) {
+	err := os.MkdirAll(containerDir(state.Id), 0755)
+	if err != nil {
+		return 1, fmt.Errorf("error creating container directory: %w", err)
+	}
+	log, err := os.OpenFile(containerLogPath(state.Id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		removeContainerState(state.Id)
+		return 1, fmt.Errorf("error creating container log: %w", err)
+	}
+	defer log.Close()
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		removeContainerState(state.Id)
+		return 1, err
+	}
+	defer devNull.Close()
+
+	specReader, specWriter, err := os.Pipe()
+	if err != nil {
+		removeContainerState(state.Id)
+		return 1, err
+	}
+	defer specWriter.Close()
+	replyReader, replyWriter, err := os.Pipe()
+	if err != nil {
+		_ = specReader.Close()
+		removeContainerState(state.Id)
+		return 1, err
+	}
+	defer replyReader.Close()
+
+	supervisor := &exec.Cmd{
+		Path:        "/proc/self/exe",
+		Args:        []string{supervisorArg},
+		Stdin:       devNull,
+		Stdout:      log,
+		Stderr:      log,
+		ExtraFiles:  []*os.File{specReader, replyWriter},
+		SysProcAttr: &syscall.SysProcAttr{Setsid: true},
+	}
+	err = supervisor.Start()
+	_ = specReader.Close()
+	_ = replyWriter.Close()
+	if err != nil {
+		removeContainerState(state.Id)
+		return 1, fmt.Errorf("error starting supervisor: %w", err)
+	}
+
+	err = json.NewEncoder(specWriter).Encode(supervisorSpec{State: state, Args: args, Options: options})
+	_ = specWriter.Close()
+	if err != nil {
+		_ = supervisor.Process.Kill()
+		_ = supervisor.Wait()
+		removeContainerState(state.Id)
+		return 1, fmt.Errorf("error starting supervisor: %w", err)
+	}
+
+	var reply supervisorReply
+	err = json.NewDecoder(replyReader).Decode(&reply)
+	if err != nil {
+		_ = supervisor.Wait()
+		return 1, fmt.Errorf("supervisor exited before starting the container, see %s", containerLogPath(state.Id))
+	}
+	if reply.Error != "" {
+		_ = supervisor.Wait()
+		// A container that failed to start is kept like any other, unless
+		// it failed before it had any state to keep.
+		if _, err := readContainerState(state.Id); os.IsNotExist(err) {
+			removeContainerState(state.Id)
+		}
+		return reply.ExitCode, errors.New(reply.Error)
+	}
+
+	_ = supervisor.Process.Release()
+	return 0, nil
+}
+
+// supervise is the entry point of the supervisor process.
+func supervise() int {
+	replyPipe := os.NewFile(supervisorReplyFd, "supervisor-reply")
+	syscall.CloseOnExec(supervisorReplyFd)
+	reply := func(reply supervisorReply) {
+		_ = json.NewEncoder(replyPipe).Encode(reply)
+		_ = replyPipe.Close()
+	}
+
+	var spec supervisorSpec
+	specPipe := os.NewFile(supervisorSpecFd, "supervisor-spec")
+	err := json.NewDecoder(specPipe).Decode(&spec)
+	_ = specPipe.Close()
+	if err != nil {
+		reply(supervisorReply{Error: fmt.Sprintf("error reading supervisor spec: %v", err), ExitCode: 1})
+		return 1
+	}
+
+	started := false
+	exitCode, err := runCommand(spec.State, spec.Args, spec.Options, func(containerState) {
+		started = true
+		reply(supervisorReply{})
+	})
+	if err != nil && !started {
+		reply(supervisorReply{Error: err.Error(), ExitCode: exitCode})
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "mydocker: %v\n", err)
+	}
+
+	return exitCode
+}
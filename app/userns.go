@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// idMap maps the user and group IDs of a user namespace to host IDs. An
+// empty idMap means the container shares the host's IDs.
+type idMap struct {
+	Uids []syscall.SysProcIDMap
+	Gids []syscall.SysProcIDMap
+}
+
+// parseIdMappings parses mappings of the form "CONTAINER_ID:HOST_ID:SIZE",
+// as given to --uidmap and --gidmap.
+func parseIdMappings(values []string) ([]syscall.SysProcIDMap, error) {
+	var mappings []syscall.SysProcIDMap
+	for _, value := range values {
+		parts := strings.Split(value, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid ID mapping %q: expected CONTAINER_ID:HOST_ID:SIZE", value)
+		}
+
+		var ids [3]int
+		for i, part := range parts {
+			id, err := strconv.Atoi(part)
+			if err != nil || id < 0 {
+				return nil, fmt.Errorf("invalid ID mapping %q: %q is not a valid ID", value, part)
+			}
+			ids[i] = id
+		}
+		if ids[2] == 0 {
+			return nil, fmt.Errorf("invalid ID mapping %q: size must be positive", value)
+		}
+
+		mappings = append(mappings, syscall.SysProcIDMap{ContainerID: ids[0], HostID: ids[1], Size: ids[2]})
+	}
+
+	return mappings, nil
+}
+
+// newIdMap builds the ID map of a container from --uidmap and --gidmap. As
+// with podman, a map given for only one of them applies to both.
+func newIdMap(uidMappings, gidMappings []string) (idMap, error) {
+	uids, err := parseIdMappings(uidMappings)
+	if err != nil {
+		return idMap{}, err
+	}
+	gids, err := parseIdMappings(gidMappings)
+	if err != nil {
+		return idMap{}, err
+	}
+
+	if len(gids) == 0 {
+		gids = uids
+	}
+	if len(uids) == 0 {
+		uids = gids
+	}
+
+	return idMap{Uids: uids, Gids: gids}, nil
+}
+
+// enabled reports whether the container gets a user namespace.
+func (m idMap) enabled() bool {
+	return len(m.Uids) > 0
+}
+
+// shifted reports whether IDs in the container differ from those on the
+// host, in which case the files of the rootfs need their ownership shifted
+// for the container to own them.
+func (m idMap) shifted() bool {
+	identity := func(mappings []syscall.SysProcIDMap) bool {
+		for _, mapping := range mappings {
+			if mapping.ContainerID != mapping.HostID {
+				return false
+			}
+		}
+		return true
+	}
+	return !identity(m.Uids) || !identity(m.Gids)
+}
+
+// hostUid returns the host ID of the container user uid, or uid itself when
+// it is not mapped.
+func (m idMap) hostUid(uid int) int {
+	return hostId(m.Uids, uid)
+}
+
+func (m idMap) hostGid(gid int) int {
+	return hostId(m.Gids, gid)
+}
+
+func hostId(mappings []syscall.SysProcIDMap, id int) int {
+	for _, mapping := range mappings {
+		if id >= mapping.ContainerID && id < mapping.ContainerID+mapping.Size {
+			return mapping.HostID + id - mapping.ContainerID
+		}
+	}
+	return id
+}